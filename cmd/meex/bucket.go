@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Orbit is the nominal orbital period of the ISS.
+const Orbit = 5580 * time.Second
+
+const (
+	calendarDOY   = "doy"
+	calendarWeek  = "week"
+	calendarMonth = "month"
+	calendarYear  = "year"
+)
+
+// Bucket accepts a duration (eg: 5m, 1h), hour, day, orbit (optionally
+// prefixed by a count: 2orbit, 7day) or one of the calendar units doy, week
+// (starting on monday), month and year. An empty bucket or all puts every
+// packet of a key in the same bucket.
+type Bucket struct {
+	Width    time.Duration
+	Calendar string
+}
+
+func (b *Bucket) Set(v string) error {
+	v = strings.ToLower(strings.TrimSpace(v))
+	*b = Bucket{}
+	switch v {
+	case "", "all", "none":
+		return nil
+	case calendarDOY, calendarWeek, calendarMonth, calendarYear:
+		b.Calendar = v
+		return nil
+	}
+	for _, u := range []struct {
+		Name  string
+		Width time.Duration
+	}{
+		{"orbit", Orbit},
+		{"hour", time.Hour},
+		{"day", Day},
+	} {
+		if !strings.HasSuffix(v, u.Name) {
+			continue
+		}
+		n := 1
+		if s := strings.TrimSuffix(v, u.Name); s != "" {
+			c, err := strconv.Atoi(s)
+			if err != nil || c <= 0 {
+				return fmt.Errorf("invalid bucket %s", v)
+			}
+			n = c
+		}
+		b.Width = time.Duration(n) * u.Width
+		return nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return fmt.Errorf("invalid bucket %s", v)
+	}
+	b.Width = d
+	return nil
+}
+
+func (b *Bucket) String() string {
+	switch {
+	case b.Calendar != "":
+		return b.Calendar
+	case b.Width == 0:
+		return "all"
+	default:
+		return b.Width.String()
+	}
+}
+
+func (b Bucket) IsZero() bool {
+	return b.Width == 0 && b.Calendar == ""
+}
+
+func (b Bucket) Truncate(t time.Time) time.Time {
+	t = t.UTC()
+	switch b.Calendar {
+	case calendarDOY:
+		return t.Truncate(Day)
+	case calendarWeek:
+		t = t.Truncate(Day)
+		return t.AddDate(0, 0, -(int(t.Weekday())+6)%7)
+	case calendarMonth:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	case calendarYear:
+		return time.Date(t.Year(), 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	if b.Width == 0 {
+		return t
+	}
+	return t.Truncate(b.Width)
+}
+
+// Next returns the start of the bucket following the one starting at t.
+func (b Bucket) Next(t time.Time) time.Time {
+	switch b.Calendar {
+	case calendarDOY:
+		return t.AddDate(0, 0, 1)
+	case calendarWeek:
+		return t.AddDate(0, 0, 7)
+	case calendarMonth:
+		return t.AddDate(0, 1, 0)
+	case calendarYear:
+		return t.AddDate(1, 0, 0)
+	}
+	return t.Add(b.Width)
+}
+
+func (b Bucket) Format(t time.Time) string {
+	switch b.Calendar {
+	case calendarDOY:
+		return fmt.Sprintf("%04d-%03d", t.Year(), t.YearDay())
+	case calendarWeek:
+		y, w := t.ISOWeek()
+		return fmt.Sprintf("%04d-W%02d", y, w)
+	case calendarMonth:
+		return t.Format("2006-01")
+	case calendarYear:
+		return t.Format("2006")
+	}
+	if b.Width > 0 && b.Width%Day == 0 {
+		return t.Format("2006-01-02")
+	}
+	return t.Format(TimeFormat)
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type Calibrator interface {
+	Calibrate(interface{}) (interface{}, error)
+}
+
+// ParseCalibration parses the calibration of a parameter given as
+// <kind>:<arguments> where arguments are separated by commas or semicolons
+// (eg: linear:0.5;10). Supported kinds are:
+//
+//	linear:<scale>;<offset>
+//	poly:<c0>;<c1>;...;<cn>
+//	interp:<x0>=<y0>;<x1>=<y1>;...
+//	enum:<value>=<label>;...
+func ParseCalibration(v string) (Calibrator, error) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return nil, nil
+	}
+	kind, args := v, ""
+	if i := strings.Index(v, ":"); i >= 0 {
+		kind, args = strings.ToLower(v[:i]), v[i+1:]
+	}
+	switch kind {
+	case "linear":
+		vs, err := parseFloats(args)
+		if err != nil {
+			return nil, err
+		}
+		if len(vs) != 2 {
+			return nil, fmt.Errorf("linear calibration expects scale and offset")
+		}
+		return linear{scale: vs[0], offset: vs[1]}, nil
+	case "poly", "polynomial":
+		vs, err := parseFloats(args)
+		if err != nil {
+			return nil, err
+		}
+		if len(vs) == 0 {
+			return nil, fmt.Errorf("polynomial calibration expects coefficients")
+		}
+		return polynomial(vs), nil
+	case "interp", "table":
+		return parseInterpolation(args)
+	case "enum":
+		return parseEnumeration(args)
+	default:
+		return nil, fmt.Errorf("unsupported calibration %s", kind)
+	}
+}
+
+func splitArgs(v string) []string {
+	return strings.FieldsFunc(v, func(r rune) bool { return r == ',' || r == ';' })
+}
+
+func parsePairs(v string) ([][2]string, error) {
+	var vs [][2]string
+	for _, s := range splitArgs(v) {
+		i := strings.Index(s, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid pair %s", s)
+		}
+		vs = append(vs, [2]string{strings.TrimSpace(s[:i]), strings.TrimSpace(s[i+1:])})
+	}
+	return vs, nil
+}
+
+func parseFloats(v string) ([]float64, error) {
+	var vs []float64
+	for _, s := range splitArgs(v) {
+		f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %s", s)
+		}
+		vs = append(vs, f)
+	}
+	return vs, nil
+}
+
+func toFloat(v interface{}) (float64, error) {
+	switch v := v.(type) {
+	case uint64:
+		return float64(v), nil
+	case int64:
+		return float64(v), nil
+	case float64:
+		return v, nil
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	default:
+		return 0, fmt.Errorf("%v can not be calibrated", v)
+	}
+}
+
+type linear struct {
+	scale  float64
+	offset float64
+}
+
+func (l linear) Calibrate(v interface{}) (interface{}, error) {
+	f, err := toFloat(v)
+	if err != nil {
+		return nil, err
+	}
+	return f*l.scale + l.offset, nil
+}
+
+type polynomial []float64
+
+func (p polynomial) Calibrate(v interface{}) (interface{}, error) {
+	x, err := toFloat(v)
+	if err != nil {
+		return nil, err
+	}
+	var y float64
+	for i := len(p) - 1; i >= 0; i-- {
+		y = y*x + p[i]
+	}
+	return y, nil
+}
+
+type point struct {
+	x, y float64
+}
+
+// interpolation computes values by linear interpolation between the points of
+// its table. Values outside of the table are clamped to its first or last
+// point.
+type interpolation []point
+
+func parseInterpolation(v string) (Calibrator, error) {
+	ps, err := parsePairs(v)
+	if err != nil {
+		return nil, err
+	}
+	if len(ps) < 2 {
+		return nil, fmt.Errorf("interpolation expects at least two points")
+	}
+	vs := make(interpolation, 0, len(ps))
+	for _, p := range ps {
+		x, err := strconv.ParseFloat(p[0], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %s", p[0])
+		}
+		y, err := strconv.ParseFloat(p[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %s", p[1])
+		}
+		vs = append(vs, point{x: x, y: y})
+	}
+	sort.Slice(vs, func(i, j int) bool { return vs[i].x < vs[j].x })
+	return vs, nil
+}
+
+func (t interpolation) Calibrate(v interface{}) (interface{}, error) {
+	x, err := toFloat(v)
+	if err != nil {
+		return nil, err
+	}
+	if x <= t[0].x {
+		return t[0].y, nil
+	}
+	for i := 1; i < len(t); i++ {
+		if x > t[i].x {
+			continue
+		}
+		p, n := t[i-1], t[i]
+		return p.y + (x-p.x)*(n.y-p.y)/(n.x-p.x), nil
+	}
+	return t[len(t)-1].y, nil
+}
+
+type enumeration map[string]string
+
+func parseEnumeration(v string) (Calibrator, error) {
+	ps, err := parsePairs(v)
+	if err != nil {
+		return nil, err
+	}
+	e := make(enumeration)
+	for _, p := range ps {
+		e[p[0]] = p[1]
+	}
+	return e, nil
+}
+
+func (e enumeration) Calibrate(v interface{}) (interface{}, error) {
+	k := fmt.Sprint(v)
+	if s, ok := e[k]; ok {
+		return s, nil
+	}
+	return k, nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCalibrate(t *testing.T) {
+	data := []struct {
+		Calibration string
+		Value       interface{}
+		Want        interface{}
+	}{
+		{Calibration: "linear:0.5;10", Value: uint64(4), Want: float64(12)},
+		{Calibration: "linear:2,-1", Value: int64(-2), Want: float64(-5)},
+		{Calibration: "poly:1", Value: uint64(7), Want: float64(1)},
+		{Calibration: "poly:1;2;3", Value: uint64(0), Want: float64(1)},
+		{Calibration: "poly:1;2;3", Value: uint64(2), Want: float64(17)},
+		{Calibration: "polynomial:0,0,1", Value: int64(-3), Want: float64(9)},
+		{Calibration: "poly:1;1", Value: true, Want: float64(2)},
+		{Calibration: "interp:0=0;2=4;4=4", Value: uint64(1), Want: float64(2)},
+		{Calibration: "interp:0=0;2=4;4=4", Value: uint64(2), Want: float64(4)},
+		{Calibration: "interp:0=0;2=4;4=4", Value: uint64(3), Want: float64(4)},
+		{Calibration: "interp:2=4;0=0", Value: float64(0.5), Want: float64(1)},
+		{Calibration: "interp:0=0;2=4;4=4", Value: int64(-5), Want: float64(0)},
+		{Calibration: "interp:0=0;2=4;4=8", Value: uint64(100), Want: float64(8)},
+		{Calibration: "table:10=1;20=-1", Value: uint64(15), Want: float64(0)},
+		{Calibration: "enum:0=off;1=on", Value: uint64(1), Want: "on"},
+		{Calibration: "enum:false=off;true=on", Value: false, Want: "off"},
+		{Calibration: "enum:0=off;1=on", Value: uint64(2), Want: "2"},
+		{Calibration: "enum:-1=error", Value: int64(-1), Want: "error"},
+	}
+	for _, d := range data {
+		c, err := ParseCalibration(d.Calibration)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", d.Calibration, err)
+			continue
+		}
+		got, err := c.Calibrate(d.Value)
+		if err != nil {
+			t.Errorf("%s(%v): unexpected error: %s", d.Calibration, d.Value, err)
+			continue
+		}
+		if got != d.Want {
+			t.Errorf("%s(%v): got %v, want %v", d.Calibration, d.Value, got, d.Want)
+		}
+	}
+}
+
+func TestParseCalibration(t *testing.T) {
+	if c, err := ParseCalibration(" "); c != nil || err != nil {
+		t.Errorf("empty calibration: got %v %v", c, err)
+	}
+	for _, v := range []string{
+		"linear:1",
+		"linear:a;b",
+		"poly:",
+		"interp:0=0",
+		"interp:0=0;x=1",
+		"interp:0;1",
+		"enum:on",
+		"spline:1;2",
+	} {
+		if _, err := ParseCalibration(v); err == nil {
+			t.Errorf("%s: invalid calibration accepted", v)
+		}
+	}
+	c, err := ParseCalibration("poly:1;2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Calibrate("text"); err == nil {
+		t.Errorf("calibrating a string: no error")
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Filter interface {
+	Seen([]byte, time.Time) bool
+}
+
+// Window accepts a number of packets (eg: 10000), a duration measured on the
+// acquisition time of the packets (eg: 5m) or bloom:<n> where n is the
+// expected number of distinct packets.
+type Window struct {
+	Count    int
+	Interval time.Duration
+	Bloom    int
+}
+
+func (w *Window) Set(v string) error {
+	v = strings.ToLower(strings.TrimSpace(v))
+	if v == "" {
+		return fmt.Errorf("no window provided")
+	}
+	if strings.HasPrefix(v, "bloom") {
+		n := 1 << 20
+		if i := strings.Index(v, ":"); i >= 0 {
+			c, err := strconv.Atoi(v[i+1:])
+			if err != nil || c <= 0 {
+				return fmt.Errorf("invalid bloom filter size %s", v[i+1:])
+			}
+			n = c
+		}
+		w.Bloom = n
+		return nil
+	}
+	if n, err := strconv.Atoi(v); err == nil {
+		if n <= 0 {
+			return fmt.Errorf("invalid window size %d", n)
+		}
+		w.Count = n
+		return nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return fmt.Errorf("invalid window %s", v)
+	}
+	w.Interval = d
+	return nil
+}
+
+func (w *Window) IsSet() bool {
+	return w.Count > 0 || w.Interval > 0 || w.Bloom > 0
+}
+
+func (w *Window) String() string {
+	return "duplicate window"
+}
+
+func (w *Window) Filter() Filter {
+	if w.Bloom > 0 {
+		return BloomFilter(w.Bloom, 0.001)
+	}
+	return WindowFilter(w.Count, w.Interval)
+}
+
+func (w *Window) Writer(ws io.Writer, d Decoder) io.Writer {
+	return NoDuplicateWith(ws, d, w.Filter())
+}
+
+func DuplicateKey(p Packet) []byte {
+	if f := LookupPacket(p); f != nil && f.Duplicate != nil {
+		return f.Duplicate(p)
+	}
+	s := md5.Sum(p.Bytes())
+	return s[:]
+}
+
+func duplicateTM(p Packet) []byte {
+	t := p.(*TMPacket)
+	bs := make([]byte, 14)
+	binary.BigEndian.PutUint16(bs, uint16(t.CCSDS.Apid()))
+	binary.BigEndian.PutUint32(bs[2:], uint32(t.Sequence()))
+	binary.BigEndian.PutUint64(bs[6:], uint64(t.Timestamp().UnixNano()))
+	return bs
+}
+
+func duplicateTC(p Packet) []byte {
+	t := p.(*TCPacket)
+	bs := make([]byte, 14)
+	binary.BigEndian.PutUint16(bs, uint16(t.CCSDS.Apid()|0x1000))
+	binary.BigEndian.PutUint32(bs[2:], uint32(t.Sequence()))
+	binary.BigEndian.PutUint64(bs[6:], uint64(t.Timestamp().UnixNano()))
+	return bs
+}
+
+func duplicatePD(p Packet) []byte {
+	u := p.(*PDPacket)
+	bs := make([]byte, UMICodeLen+8)
+	copy(bs, u.UMI.Code[:])
+	binary.BigEndian.PutUint64(bs[UMICodeLen:], uint64(u.Timestamp().UnixNano()))
+	return bs
+}
+
+func duplicateVMU(p Packet) []byte {
+	v := p.(*VMUPacket)
+	bs := make([]byte, 5)
+	bs[0] = byte(v.VMU.Channel)
+	binary.BigEndian.PutUint32(bs[1:], v.VMU.Sequence)
+	return bs
+}
+
+type noDuplicateWriter struct {
+	decoder Decoder
+	filter  Filter
+	inner   io.Writer
+}
+
+func NoDuplicate(w io.Writer) io.Writer {
+	return NoDuplicateWith(w, nil, WindowFilter(0, 0))
+}
+
+func NoDuplicateWith(w io.Writer, d Decoder, f Filter) io.Writer {
+	return &noDuplicateWriter{
+		decoder: d,
+		filter:  f,
+		inner:   w,
+	}
+}
+
+func (w *noDuplicateWriter) Write(bs []byte) (int, error) {
+	var (
+		key  []byte
+		when time.Time
+	)
+	if w.decoder != nil {
+		if p, err := w.decoder.Decode(bs); err == nil && p != nil {
+			key, when = DuplicateKey(p), p.Timestamp()
+		}
+	}
+	if key == nil {
+		s := md5.Sum(bs)
+		key = s[:]
+	}
+	if w.filter.Seen(key, when) {
+		return len(bs), nil
+	}
+	return w.inner.Write(bs)
+}
+
+// zeroTimeCount bounds the entries of an interval window that are kept for
+// packets without time (no decoder or undecodable packets): they can not be
+// evicted on their time.
+const zeroTimeCount = 1 << 16
+
+type dupEntry struct {
+	key  string
+	when time.Time
+}
+
+type windowFilter struct {
+	count    int
+	interval time.Duration
+
+	keys  map[string]struct{}
+	queue []dupEntry
+}
+
+func WindowFilter(count int, interval time.Duration) Filter {
+	return &windowFilter{
+		count:    count,
+		interval: interval,
+		keys:     make(map[string]struct{}),
+	}
+}
+
+func (w *windowFilter) Seen(bs []byte, t time.Time) bool {
+	k := string(bs)
+	if _, ok := w.keys[k]; ok {
+		return true
+	}
+	if w.count > 0 || w.interval > 0 {
+		w.evict(t)
+		w.queue = append(w.queue, dupEntry{key: k, when: t})
+	}
+	w.keys[k] = struct{}{}
+	return false
+}
+
+func (w *windowFilter) evict(t time.Time) {
+	count := w.count
+	if count == 0 && t.IsZero() {
+		count = zeroTimeCount
+	}
+	var i int
+	for ; i < len(w.queue); i++ {
+		e := w.queue[i]
+		if count > 0 && len(w.queue)-i >= count {
+			delete(w.keys, e.key)
+			continue
+		}
+		if w.interval > 0 && t.Sub(e.when) > w.interval {
+			delete(w.keys, e.key)
+			continue
+		}
+		break
+	}
+	if i > 0 {
+		n := copy(w.queue, w.queue[i:])
+		w.queue = w.queue[:n]
+	}
+}
+
+type bloomFilter struct {
+	bits   []uint64
+	size   uint64
+	hashes int
+}
+
+func BloomFilter(n int, rate float64) Filter {
+	m := math.Ceil(-float64(n) * math.Log(rate) / (math.Ln2 * math.Ln2))
+	k := int(math.Round(m / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	size := uint64(m)
+	return &bloomFilter{
+		bits:   make([]uint64, (size+63)/64),
+		size:   size,
+		hashes: k,
+	}
+}
+
+func (b *bloomFilter) Seen(bs []byte, _ time.Time) bool {
+	h := fnv.New64a()
+	h.Write(bs)
+	sum1 := h.Sum64()
+	h.Write([]byte{0xFF})
+	sum2 := h.Sum64() | 1
+
+	seen := true
+	for i := 0; i < b.hashes; i++ {
+		ix := (sum1 + uint64(i)*sum2) % b.size
+		word, bit := ix/64, uint64(1)<<(ix%64)
+		if b.bits[word]&bit == 0 {
+			seen = false
+			b.bits[word] |= bit
+		}
+	}
+	return seen
+}
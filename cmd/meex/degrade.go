@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+
+	"github.com/midbel/cli"
+)
+
+var degradeCommand = &cli.Command{
+	Usage: "degrade [-k type] [-seed seed] [-d drop] [-b burst] [-u duplicate] [-r reorder] [-w window] [-f flip] [-e error] [-c code] [-z size] [-t truncate] <source> <target>",
+	Alias: []string{"corrupt"},
+	Short: "apply faults to packets of a RT file",
+	Run:   runDegrade,
+}
+
+type Degrader struct {
+	Drop      float64
+	Burst     int
+	Duplicate float64
+	Reorder   float64
+	Window    int
+	Flip      float64
+	Error     float64
+	Code      uint16
+	Size      float64
+	Truncate  bool
+
+	decoder Decoder
+	rand    *rand.Rand
+}
+
+type Faults struct {
+	Count      uint64
+	Dropped    uint64
+	Duplicated uint64
+	Reordered  uint64
+	Flipped    uint64
+	Errored    uint64
+	Resized    uint64
+	Truncated  uint64
+}
+
+func (d *Degrader) Degrade(s Scanner, w io.Writer) (*Faults, error) {
+	var (
+		z     Faults
+		burst int
+		queue [][]byte
+		last  []byte
+	)
+	flush := func(n int, shuffle bool) error {
+		if shuffle && n > 1 {
+			d.rand.Shuffle(n, func(i, j int) { queue[i], queue[j] = queue[j], queue[i] })
+		}
+		for _, bs := range queue[:n] {
+			if last != nil {
+				if _, err := w.Write(last); err != nil {
+					return err
+				}
+			}
+			last = bs
+		}
+		queue = queue[n:]
+		return nil
+	}
+	for s.Scan() {
+		z.Count++
+		if burst > 0 {
+			burst--
+			z.Dropped++
+			continue
+		}
+		if d.hit(d.Drop) {
+			burst = d.Burst - 1
+			z.Dropped++
+			continue
+		}
+		bs := make([]byte, len(s.Bytes()))
+		copy(bs, s.Bytes())
+
+		if d.hit(d.Flip) && d.flip(bs) {
+			z.Flipped++
+		}
+		if d.hit(d.Error) && d.setError(bs) {
+			z.Errored++
+		}
+		if d.hit(d.Size) {
+			z.Resized++
+			d.resize(bs)
+		}
+		queue = append(queue, bs)
+		if d.hit(d.Duplicate) {
+			z.Duplicated++
+			queue = append(queue, append([]byte(nil), bs...))
+		}
+		if d.Reorder > 0 && len(queue) >= d.Window {
+			if d.hit(d.Reorder) {
+				z.Reordered++
+				if err := flush(len(queue), true); err != nil {
+					return nil, err
+				}
+			} else if err := flush(1, false); err != nil {
+				return nil, err
+			}
+		} else if d.Reorder <= 0 {
+			if err := flush(len(queue), false); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if err := flush(len(queue), false); err != nil {
+		return nil, err
+	}
+	if last == nil {
+		return &z, nil
+	}
+	if d.Truncate && len(last) > 4 {
+		z.Truncated++
+		last = last[:4+d.rand.Intn(len(last)-4)]
+	}
+	_, err := w.Write(last)
+	return &z, err
+}
+
+func (d *Degrader) hit(ratio float64) bool {
+	if ratio <= 0 {
+		return false
+	}
+	return d.rand.Float64()*100 < ratio
+}
+
+func (d *Degrader) offset(bs []byte) int {
+	if d.decoder == nil {
+		return 4
+	}
+	p, err := d.decoder.Decode(bs)
+	if err != nil {
+		return 4
+	}
+	if f := LookupPacket(p); f != nil && f.Payload > 4 {
+		return f.Payload
+	}
+	return 4
+}
+
+func (d *Degrader) flip(bs []byte) bool {
+	offset := d.offset(bs)
+	if offset >= len(bs) {
+		return false
+	}
+	ix := offset + d.rand.Intn(len(bs)-offset)
+	bs[ix] ^= 1 << uint(d.rand.Intn(8))
+	return true
+}
+
+// setError sets the error code in the HRDL header of the VMU packets whatever
+// the packet type given to the degrader.
+func (d *Degrader) setError(bs []byte) bool {
+	if p, err := decodeVMU(bs); err != nil {
+		return false
+	} else if _, ok := p.(*VMUPacket); !ok {
+		return false
+	}
+	code := d.Code
+	if code == 0 {
+		code = uint16(1 << uint(d.rand.Intn(16)))
+	}
+	binary.BigEndian.PutUint16(bs[4:], code)
+	return true
+}
+
+func (d *Degrader) resize(bs []byte) {
+	size := binary.LittleEndian.Uint32(bs)
+	switch delta := uint32(1 + d.rand.Intn(16)); d.rand.Intn(3) {
+	case 0:
+		size += delta
+	case 1:
+		if size > delta {
+			size -= delta
+		}
+	default:
+		size = d.rand.Uint32()
+	}
+	binary.LittleEndian.PutUint32(bs, size)
+}
+
+func runDegrade(cmd *cli.Command, args []string) error {
+	var (
+		kind Kind
+		code uint
+		d    Degrader
+	)
+	cmd.Flag.Var(&kind, "k", "packet type")
+	cmd.Flag.Float64Var(&d.Drop, "d", 0, "percent of dropped packets")
+	cmd.Flag.IntVar(&d.Burst, "b", 1, "packets dropped per burst")
+	cmd.Flag.Float64Var(&d.Duplicate, "u", 0, "percent of duplicated packets")
+	cmd.Flag.Float64Var(&d.Reorder, "r", 0, "percent of reordered windows")
+	cmd.Flag.IntVar(&d.Window, "w", 8, "reorder window")
+	cmd.Flag.Float64Var(&d.Flip, "f", 0, "percent of packets with flipped bit")
+	cmd.Flag.Float64Var(&d.Error, "e", 0, "percent of packets with HRDL error")
+	cmd.Flag.UintVar(&code, "c", 0, "HRDL error code")
+	cmd.Flag.Float64Var(&d.Size, "z", 0, "percent of packets with corrupted size")
+	cmd.Flag.BoolVar(&d.Truncate, "t", false, "truncate last packet")
+	var seed Seed
+	cmd.Flag.Var(&seed, "seed", "random seed")
+	if err := cmd.Flag.Parse(args); err != nil {
+		return err
+	}
+	if f := kind.Family; d.Error > 0 && f != nil && f.Name != "vmu" && f.Name != "hrd" {
+		return fmt.Errorf("HRDL errors can only be set in VMU packets (got %s)", f.Name)
+	}
+	d.Code, d.decoder, d.rand = uint16(code), kind.Decod, seed.Rand()
+	if d.Burst < 1 {
+		d.Burst = 1
+	}
+
+	r, err := os.Open(cmd.Flag.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	file := cmd.Flag.Arg(1)
+	if d, f := filepath.Split(file); f == "" {
+		file = filepath.Join(d, "degrade.dat")
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil && !os.IsExist(err) {
+		return err
+	}
+	w, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	z, err := d.Degrade(Scan(r), w)
+	if err != nil {
+		os.Remove(file)
+		return err
+	}
+	const row = "%d packets: %d dropped, %d duplicated, %d reordered, %d flipped, %d errors, %d resized, %d truncated"
+	log.Printf(row, z.Count, z.Dropped, z.Duplicated, z.Reordered, z.Flipped, z.Errored, z.Resized, z.Truncated)
+	return nil
+}
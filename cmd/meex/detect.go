@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/midbel/cli"
+)
+
+const KindUnknown = "unknown"
+
+var detectCommand = &cli.Command{
+	Usage: "detect [-n count] <file...>",
+	Alias: []string{"sniff"},
+	Short: "detect the type of packets stored in RT file(s)",
+	Run:   runDetect,
+}
+
+func runDetect(cmd *cli.Command, args []string) error {
+	count := cmd.Flag.Int("n", 16, "packets inspected")
+	if err := cmd.Flag.Parse(args); err != nil {
+		return err
+	}
+	const row = "%-8s | %4d/%-4d | %s"
+
+	var errs int
+	for _, a := range cmd.Flag.Args() {
+		err := filepath.Walk(a, func(p string, i os.FileInfo, err error) error {
+			if err != nil {
+				errs++
+				log.Printf("error: %s", err)
+				return nil
+			}
+			if i.IsDir() {
+				return nil
+			}
+			k, n, total, err := DetectFile(p, *count)
+			if err != nil {
+				errs++
+				log.Printf("error: %s: %s", p, err)
+				return nil
+			}
+			log.Printf(row, k, n, total, p)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if errs > 0 {
+		return fmt.Errorf("%d files could not be inspected", errs)
+	}
+	return nil
+}
+
+func DetectFile(file string, count int) (string, int, int, error) {
+	sc, err := ScanFile(file)
+	if err != nil {
+		return KindUnknown, 0, 0, err
+	}
+	defer sc.Close()
+
+	var (
+		total int
+		kinds = make(map[string]int)
+	)
+	for total < count && sc.Scan() {
+		total++
+		kinds[Detect(sc.Bytes())]++
+	}
+	if err := sc.Err(); err != nil {
+		return KindUnknown, 0, total, err
+	}
+	kind, n := KindUnknown, 0
+	for k, c := range kinds {
+		if k != KindUnknown && c > n {
+			kind, n = k, c
+		}
+	}
+	return kind, n, total, nil
+}
+
+func Detect(bs []byte) string {
+	if f := DetectFamily(bs); f != nil {
+		return f.Name
+	}
+	return KindUnknown
+}
+
+func DetectFamily(bs []byte) *Family {
+	for _, f := range families {
+		if f.Detect != nil && f.Detect(bs) {
+			return f
+		}
+	}
+	return nil
+}
+
+func isVMU(bs []byte) bool {
+	if len(bs) < HRDLHeaderLen+VMUHeaderLen+4 {
+		return false
+	}
+	return binary.LittleEndian.Uint32(bs[HRDLHeaderLen:]) == HRDLSyncWord
+}
+
+func isTM(bs []byte) bool {
+	if len(bs) < PTHHeaderLen+CCSDSHeaderLen+ESAHeaderLen || bs[4] != 0x09 {
+		return false
+	}
+	if bs[PTHHeaderLen]>>5 != 0 || bs[PTHHeaderLen]&0x08 == 0 {
+		return false
+	}
+	size := binary.BigEndian.Uint16(bs[PTHHeaderLen+4:])
+	return int(size)+1+CCSDSHeaderLen == len(bs)-PTHHeaderLen
+}
+
+func isPD(bs []byte) bool {
+	if len(bs) < UMIHeaderLen {
+		return false
+	}
+	var u UMIHeader
+	if err := u.UnmarshalBinary(bs); err != nil {
+		return false
+	}
+	if u.State > StateErrorValue || u.Type < Int32 || u.Type > Bit {
+		return false
+	}
+	return int(u.Len) == len(bs)-UMIHeaderLen
+}
+
+type autoDecoder struct {
+	decoders map[string]Decoder
+	decoder  Decoder
+}
+
+// DecodeAuto gives a decoder that detects the packet type from the first
+// recognized packet of a file and decodes the rest of the file with the
+// decoder of that type.
+func DecodeAuto() Decoder {
+	ds := make(map[string]Decoder)
+	for _, f := range families {
+		if f.Detect != nil {
+			ds[f.Name] = f.Decoder()
+		}
+	}
+	return &autoDecoder{decoders: ds}
+}
+
+func (a *autoDecoder) ForFile() Decoder {
+	return &autoDecoder{decoders: a.decoders}
+}
+
+func (a *autoDecoder) Decode(bs []byte) (Packet, error) {
+	if a.decoder == nil {
+		d, ok := a.decoders[Detect(bs)]
+		if !ok {
+			return nil, fmt.Errorf("unrecognized packet type")
+		}
+		a.decoder = d
+	}
+	return a.decoder.Decode(bs)
+}
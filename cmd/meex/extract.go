@@ -20,7 +20,7 @@ var dispatchCommand = &cli.Command{
 }
 
 var extractCommand = &cli.Command{
-	Usage: "extract [-p pid] [-k type] [-t time] [-i interval] [-d datadir] [-c body-only] <file...>",
+	Usage: "extract [-p pid] [-k type] [-t time] [-i interval] [-d datadir] [-c body-only] [-w window] <file...>",
 	Alias: []string{"filter"},
 	Short: "extract packets from RT file(s)",
 	Run:   runExtract,
@@ -37,28 +37,63 @@ func runDispatch(cmd *cli.Command, args []string) error {
 		return err
 	}
 
-	ws := make(map[time.Time]io.WriteCloser)
-	delta := GPS.Sub(UNIX)
-	for p := range Walk(cmd.Flag.Args(), kind.Decod) {
-		t := p.Timestamp().Add(delta).Truncate(Five)
-		w, ok := ws[t]
-		if !ok {
-			file, err := TimePath(*datadir, t)
-			if err != nil {
-				return err
-			}
-			w, err = os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-			if err != nil {
-				return err
-			}
-			defer w.Close()
-			ws[t] = w
+	ctx, cancel := Interrupt()
+	defer cancel()
+
+	a := NewArchive(*datadir)
+	defer a.Close()
+
+	walker := NewWalker(ctx, cmd.Flag.Args(), kind.Decod)
+	defer walker.Close()
+	for p := range walker.Walk() {
+		if err := a.Write(p); err != nil {
+			return err
+		}
+	}
+	return walker.Err()
+}
+
+// Archive writes packets in the rt files of a data directory according to
+// their acquisition time.
+type Archive struct {
+	dir string
+	ws  map[time.Time]io.WriteCloser
+}
+
+func NewArchive(dir string) *Archive {
+	return &Archive{
+		dir: dir,
+		ws:  make(map[time.Time]io.WriteCloser),
+	}
+}
+
+func (a *Archive) Write(p Packet) error {
+	t := p.Timestamp().Add(GPS.Sub(UNIX)).Truncate(Five)
+	w, ok := a.ws[t]
+	if !ok {
+		file, err := TimePath(a.dir, t)
+		if err != nil {
+			return err
 		}
-		if _, err := w.Write(p.Bytes()); err != nil {
+		w, err = os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
 			return err
 		}
+		a.ws[t] = w
 	}
-	return nil
+	_, err := w.Write(p.Bytes())
+	return err
+}
+
+func (a *Archive) Close() error {
+	var err error
+	for t, w := range a.ws {
+		if e := w.Close(); e != nil && err == nil {
+			err = e
+		}
+		delete(a.ws, t)
+	}
+	return err
 }
 
 func runExtract(cmd *cli.Command, args []string) error {
@@ -68,32 +103,31 @@ func runExtract(cmd *cli.Command, args []string) error {
 	interval := cmd.Flag.Duration("i", 0, "interval")
 	kind := cmd.Flag.String("k", "", "packet type")
 	cut := cmd.Flag.Bool("c", false, "only packets body")
+	var window Window
+	cmd.Flag.Var(&window, "w", "duplicate window")
 	if err := cmd.Flag.Parse(args); err != nil {
 		return err
 	}
 
-	var (
-		d    Decoder
-		size int
-	)
-	switch strings.ToLower(*kind) {
-	default:
-		return fmt.Errorf("unsupported packet type %s", *kind)
-	case "pd", "pp":
-		if *cut {
-			size = UMIHeaderLen
-		}
-		d = DecodePD()
-	case "tm", "pth":
-		if *cut {
-			size = PTHHeaderLen
-		}
-		d = DecodeTM()
-	case "hrdl", "hrd", "vmu":
-		if *cut {
-			size = HRDLHeaderLen
-		}
-		d = DecodeVMU()
+	name, opts := *kind, ""
+	if i := strings.Index(name, ":"); i >= 0 {
+		name, opts = name[:i], name[i+1:]
+	}
+	f, err := Lookup(name)
+	if err != nil {
+		return err
+	}
+	if f.Name == "hrd" {
+		// the HRD packets are extracted with the VMU records holding them
+		f, _ = Lookup("vmu")
+	}
+	var size int
+	if *cut {
+		size = f.Header
+	}
+	d, err := f.DecoderWith(opts)
+	if err != nil {
+		return err
 	}
 	d = DecodeById(*id, d)
 
@@ -113,7 +147,7 @@ func runExtract(cmd *cli.Command, args []string) error {
 		src, dst := a, filepath.Join(*datadir, a)
 		group.Go(func() error {
 			sema <- struct{}{}
-			c, err := extractPackets(src, dst, d, size, when, *interval)
+			c, err := extractPackets(src, dst, d, window.Filter(), size, when, *interval)
 			if err != nil {
 				os.Remove(dst)
 			} else {
@@ -126,7 +160,7 @@ func runExtract(cmd *cli.Command, args []string) error {
 	return group.Wait()
 }
 
-func extractPackets(src, dst string, d Decoder, cut int, when time.Time, interval time.Duration) (*Coze, error) {
+func extractPackets(src, dst string, d Decoder, f Filter, cut int, when time.Time, interval time.Duration) (*Coze, error) {
 	r, err := os.Open(src)
 	if err != nil {
 		return nil, err
@@ -142,7 +176,7 @@ func extractPackets(src, dst string, d Decoder, cut int, when time.Time, interva
 	}
 	defer w.Close()
 
-	rt, ws := NewReader(r, d), NoDuplicate(w)
+	rt := NewReader(r, d)
 
 	var c Coze
 	for p := range rt.Packets() {
@@ -150,14 +184,20 @@ func extractPackets(src, dst string, d Decoder, cut int, when time.Time, interva
 		if !shouldKeepPacket(p, when, interval) {
 			continue
 		}
+		if f.Seen(DuplicateKey(p), p.Timestamp()) {
+			continue
+		}
 		bs := p.Bytes()
-		if n, err := ws.Write(bs[cut:]); err != nil {
+		if n, err := w.Write(bs[cut:]); err != nil {
 			return nil, err
 		} else {
 			c.Missing++
 			c.Size += uint64(n)
 		}
 	}
+	if err := rt.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %s", src, err)
+	}
 	return &c, nil
 }
 
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/midbel/cli"
+)
+
+const (
+	AOSHeaderLen  = 6
+	MPDUHeaderLen = 2
+	TMFHeaderLen  = 6
+	ASMLen        = 4
+
+	DefaultFrameLen = 1115
+
+	pointerIdle   = 0x7FE
+	pointerNoHead = 0x7FF
+	idleChannel   = 0x3F
+	idleApid      = 0x7FF
+)
+
+var ASM = []byte{0x1A, 0xCF, 0xFC, 0x1D}
+
+var (
+	ErrFramed  = errors.New("transfer frames can not be indexed")
+	ErrPointer = errors.New("invalid first header pointer")
+	ErrSync    = errors.New("attached sync marker not found")
+)
+
+var framesCommand = &cli.Command{
+	Usage: "frames [-k type] [-g] [-a] <file...>",
+	Alias: []string{"vcdu"},
+	Short: "check transfer frames and virtual channels",
+	Run:   runFrames,
+}
+
+type FrameType int
+
+const (
+	FrameAOS FrameType = iota
+	FrameTM
+)
+
+func (f FrameType) String() string {
+	if f == FrameTM {
+		return "tm"
+	}
+	return "aos"
+}
+
+type Frame struct {
+	Version    int
+	Spacecraft int
+	Channel    int
+	Counter    uint32
+	Replay     bool
+	Pointer    int
+	Data       []byte
+
+	Missing uint32
+	Packets int
+}
+
+func (f *Frame) Idle() bool {
+	return f.Pointer == pointerIdle
+}
+
+type FrameStats struct {
+	Channel   int
+	Frames    uint64
+	Idle      uint64
+	Packets   uint64
+	Fills     uint64
+	Gaps      uint64
+	Missing   uint64
+	Discarded uint64
+	Errors    uint64
+}
+
+type FrameConfig struct {
+	Type    FrameType
+	Length  int
+	Sync    bool
+	Insert  int
+	OCF     bool
+	FECF    bool
+	PEC     bool
+	Decoder Decoder
+}
+
+// ParseFrameConfig accepts a comma separated list of options: the frame length
+// (ASM included), asm, ocf, fecf, pec (packets carry a CRC) and insert=<n>
+// for the AOS insert zone.
+func ParseFrameConfig(t FrameType, v string) (FrameConfig, error) {
+	c := FrameConfig{Type: t, Length: DefaultFrameLen}
+	for _, o := range strings.Split(v, ",") {
+		switch o = strings.TrimSpace(o); {
+		case o == "":
+		case o == "asm":
+			c.Sync = true
+		case o == "ocf":
+			c.OCF = true
+		case o == "fecf":
+			c.FECF = true
+		case o == "pec":
+			c.PEC = true
+		case strings.HasPrefix(o, "insert="):
+			n, err := strconv.Atoi(o[7:])
+			if err != nil || n < 0 {
+				return c, fmt.Errorf("invalid insert zone %s", o[7:])
+			}
+			c.Insert = n
+		default:
+			n, err := strconv.Atoi(o)
+			if err != nil || n <= c.header() {
+				return c, fmt.Errorf("invalid frame option %s", o)
+			}
+			c.Length = n
+		}
+	}
+	return c, nil
+}
+
+func (c FrameConfig) header() int {
+	n := TMFHeaderLen
+	if c.Type == FrameAOS {
+		n = AOSHeaderLen + c.Insert + MPDUHeaderLen
+	}
+	if c.Sync {
+		n += ASMLen
+	}
+	return n
+}
+
+func (c FrameConfig) trailer() int {
+	var n int
+	if c.OCF {
+		n += 4
+	}
+	if c.FECF {
+		n += 2
+	}
+	return n
+}
+
+func (c FrameConfig) Framing() Framer {
+	return Framer{
+		Header: c.header(),
+		Length: func(_ []byte) int { return c.Length },
+	}
+}
+
+func (c FrameConfig) Decode(bs []byte) (Packet, error) {
+	return c.Decoder.Decode(bs)
+}
+
+func (c FrameConfig) Demux() *Demux {
+	return &Demux{
+		config:   c,
+		channels: make(map[int]*channelState),
+	}
+}
+
+func DecodeFrames(t FrameType, opts string) (Decoder, error) {
+	c, err := ParseFrameConfig(t, opts)
+	if err != nil {
+		return nil, err
+	}
+	c.Decoder = DecodeCCSDS(true, TMOptions{PEC: c.PEC})
+	return c, nil
+}
+
+func (c FrameConfig) DecodeFrame(bs []byte) (*Frame, error) {
+	if len(bs) < c.Length {
+		return nil, ErrShortBuffer
+	}
+	bs = bs[:c.Length]
+	if c.Sync {
+		if string(bs[:ASMLen]) != string(ASM) {
+			return nil, ErrSync
+		}
+		bs = bs[ASMLen:]
+	}
+	var f Frame
+	switch c.Type {
+	case FrameAOS:
+		id := binary.BigEndian.Uint16(bs)
+		f.Version = int(id >> 14)
+		f.Spacecraft = int(id>>6) & 0xFF
+		f.Channel = int(id & 0x3F)
+		f.Counter = uint32(bs[2])<<16 | uint32(bs[3])<<8 | uint32(bs[4])
+		f.Replay = bs[5]&0x80 == 0x80
+
+		bs = bs[AOSHeaderLen+c.Insert:]
+		f.Pointer = int(binary.BigEndian.Uint16(bs) & 0x7FF)
+		bs = bs[MPDUHeaderLen:]
+	case FrameTM:
+		id := binary.BigEndian.Uint16(bs)
+		f.Version = int(id >> 14)
+		f.Spacecraft = int(id>>4) & 0x3FF
+		f.Channel = int(id>>1) & 0x07
+		f.Counter = uint32(bs[3])
+		f.Pointer = int(binary.BigEndian.Uint16(bs[4:]) & 0x7FF)
+		bs = bs[TMFHeaderLen:]
+	}
+	f.Data = bs[:len(bs)-c.trailer()]
+	return &f, nil
+}
+
+func (c FrameConfig) modulo() uint32 {
+	if c.Type == FrameTM {
+		return 1 << 8
+	}
+	return 1 << 24
+}
+
+type Demuxer interface {
+	Demux() *Demux
+}
+
+func demuxOf(d Decoder) *Demux {
+	if x, ok := d.(Demuxer); ok {
+		return x.Demux()
+	}
+	return nil
+}
+
+type channelState struct {
+	FrameStats
+
+	last   uint32
+	seen   bool
+	synced bool
+	buffer []byte
+}
+
+type Demux struct {
+	config   FrameConfig
+	channels map[int]*channelState
+
+	pos   int64
+	queue [][]byte
+}
+
+func (d *Demux) Push(bs []byte) (*Frame, [][]byte, error) {
+	f, err := d.config.DecodeFrame(bs)
+	if err != nil {
+		return nil, nil, err
+	}
+	c, ok := d.channels[f.Channel]
+	if !ok {
+		c = &channelState{FrameStats: FrameStats{Channel: f.Channel}}
+		d.channels[f.Channel] = c
+	}
+	c.Frames++
+	if c.seen {
+		mod := d.config.modulo()
+		if diff := (f.Counter + mod - c.last - 1) % mod; diff > 0 {
+			f.Missing = diff
+			c.Gaps++
+			c.Missing += uint64(diff)
+			c.reset()
+		}
+	}
+	c.last, c.seen = f.Counter, true
+
+	if f.Idle() || (d.config.Type == FrameAOS && f.Channel == idleChannel) {
+		c.Idle++
+		return f, nil, nil
+	}
+	var ps [][]byte
+	switch {
+	case f.Pointer == pointerNoHead:
+		if c.synced {
+			c.buffer = append(c.buffer, f.Data...)
+			ps = c.extract()
+		} else {
+			c.Discarded += uint64(len(f.Data))
+		}
+	case f.Pointer >= len(f.Data):
+		c.Errors++
+		c.reset()
+		return f, nil, fmt.Errorf("%w (%d)", ErrPointer, f.Pointer)
+	default:
+		if c.synced {
+			c.buffer = append(c.buffer, f.Data[:f.Pointer]...)
+			ps = c.extract()
+			c.Discarded += uint64(len(c.buffer))
+		} else {
+			c.Discarded += uint64(f.Pointer)
+		}
+		c.buffer, c.synced = append([]byte(nil), f.Data[f.Pointer:]...), true
+		ps = append(ps, c.extract()...)
+	}
+	f.Packets = len(ps)
+	return f, ps, nil
+}
+
+func (d *Demux) Stats() []FrameStats {
+	vs := make([]FrameStats, 0, len(d.channels))
+	for _, c := range d.channels {
+		vs = append(vs, c.FrameStats)
+	}
+	sort.Slice(vs, func(i, j int) bool { return vs[i].Channel < vs[j].Channel })
+	return vs
+}
+
+func (d *Demux) next(read func() (int64, []byte, error), decoder Decoder) (Packet, error) {
+	for len(d.queue) == 0 {
+		pos, bs, err := read()
+		if err != nil {
+			return nil, err
+		}
+		_, ps, err := d.Push(bs)
+		if err != nil {
+			return nil, &PacketError{Offset: pos, Err: err, Corrupted: true}
+		}
+		d.pos, d.queue = pos, ps
+	}
+	bs := d.queue[0]
+	d.queue = d.queue[1:]
+	return decodeAt(decoder, bs, d.pos)
+}
+
+func (c *channelState) reset() {
+	c.Discarded += uint64(len(c.buffer))
+	c.buffer, c.synced = nil, false
+}
+
+func (c *channelState) extract() [][]byte {
+	var ps [][]byte
+	for len(c.buffer) >= CCSDSHeaderLen {
+		size := int(binary.BigEndian.Uint16(c.buffer[4:])) + 1 + CCSDSHeaderLen
+		if len(c.buffer) < size {
+			break
+		}
+		if apid := binary.BigEndian.Uint16(c.buffer) & 0x07FF; apid == idleApid {
+			c.Fills++
+		} else {
+			ps = append(ps, append([]byte(nil), c.buffer[:size]...))
+			c.Packets++
+		}
+		c.buffer = c.buffer[size:]
+	}
+	if len(c.buffer) == 0 {
+		c.buffer = nil
+	}
+	return ps
+}
+
+func runFrames(cmd *cli.Command, args []string) error {
+	var kind Kind
+	cmd.Flag.Var(&kind, "k", "frame type")
+	gaps := cmd.Flag.Bool("g", false, "only show frame count gaps")
+	all := cmd.Flag.Bool("a", false, "show idle frames")
+	if err := cmd.Flag.Parse(args); err != nil {
+		return err
+	}
+	if kind.Decod == nil {
+		kind.Set("aos")
+	}
+	config, ok := kind.Decod.(FrameConfig)
+	if !ok {
+		return fmt.Errorf("packet type is not a transfer frame type")
+	}
+
+	const (
+		row = "%3d | %4d | %8d | %-5t | %4d | %3d | %d"
+		gap = "%3d | %8d | %8d | %d"
+	)
+	var rejected int
+	d := config.Demux()
+	for _, p := range cmd.Flag.Args() {
+		err := filepath.Walk(p, func(p string, i os.FileInfo, err error) error {
+			if err != nil || i.IsDir() {
+				return err
+			}
+			r, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			defer r.Close()
+
+			bs := make([]byte, config.Length)
+			for i := 0; ; i++ {
+				if _, err := io.ReadFull(r, bs); err != nil {
+					if err == io.EOF {
+						return nil
+					}
+					return fmt.Errorf("%s: %w", p, ErrTruncated)
+				}
+				f, _, err := d.Push(bs)
+				if f == nil {
+					rejected++
+					log.Printf("%s: frame %d rejected: %s", p, i, err)
+					continue
+				}
+				if err != nil {
+					log.Printf("%s: %s", p, err)
+				}
+				switch {
+				case *gaps:
+					if f.Missing > 0 {
+						mod := config.modulo()
+						log.Printf(gap, f.Channel, (f.Counter+mod-f.Missing-1)%mod, f.Counter, f.Missing)
+					}
+				case !f.Idle() || *all:
+					log.Printf(row, f.Channel, f.Spacecraft, f.Counter, f.Replay, f.Pointer, f.Packets, f.Missing)
+				}
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	const stat = "VC %2d: %d frames (%d idle), %d packets (%d idle), %d gaps (%d missing frames), %d bytes discarded, %d errors"
+	for _, s := range d.Stats() {
+		log.Printf(stat, s.Channel, s.Frames, s.Idle, s.Packets, s.Fills, s.Gaps, s.Missing, s.Discarded, s.Errors)
+	}
+	if rejected > 0 {
+		return fmt.Errorf("%d frames rejected", rejected)
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+// testFrameLen gives frames carrying 32 bytes of data.
+const testFrameLen = AOSHeaderLen + MPDUHeaderLen + 32
+
+func testDemux(t *testing.T) *Demux {
+	t.Helper()
+	c, err := ParseFrameConfig(FrameAOS, "40")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c.Demux()
+}
+
+func testFrame(channel int, counter uint32, pointer int, data []byte) []byte {
+	bs := make([]byte, testFrameLen)
+	binary.BigEndian.PutUint16(bs, uint16(1<<14|0x42<<6|channel))
+	bs[2], bs[3], bs[4] = byte(counter>>16), byte(counter>>8), byte(counter)
+	binary.BigEndian.PutUint16(bs[AOSHeaderLen:], uint16(pointer))
+	copy(bs[AOSHeaderLen+MPDUHeaderLen:], data)
+	return bs
+}
+
+func testSpacePacket(apid, size int) []byte {
+	bs := make([]byte, size)
+	binary.BigEndian.PutUint16(bs, uint16(apid))
+	binary.BigEndian.PutUint16(bs[4:], uint16(size-CCSDSHeaderLen-1))
+	for i := CCSDSHeaderLen; i < size; i++ {
+		bs[i] = byte(apid + i)
+	}
+	return bs
+}
+
+func TestDemuxSpanningPackets(t *testing.T) {
+	var (
+		a = testSpacePacket(1, 16)
+		b = testSpacePacket(2, 36)
+		c = testSpacePacket(3, 12)
+		d = testSpacePacket(4, 70)
+		e = testSpacePacket(5, 26)
+	)
+	stream := bytes.Join([][]byte{a, b, c, d, e}, nil)
+	data := []struct {
+		Pointer int
+		Want    [][]byte
+	}{
+		{Pointer: 0, Want: [][]byte{a}},
+		{Pointer: 20, Want: [][]byte{b, c}},
+		{Pointer: 0},
+		{Pointer: pointerNoHead},
+		{Pointer: 6, Want: [][]byte{d, e}},
+	}
+	dx := testDemux(t)
+	for i, x := range data {
+		bs := testFrame(1, uint32(i), x.Pointer, stream[i*32:(i+1)*32])
+		f, ps, err := dx.Push(bs)
+		if err != nil {
+			t.Fatalf("frame %d: unexpected error: %s", i, err)
+		}
+		if f.Packets != len(x.Want) || len(ps) != len(x.Want) {
+			t.Fatalf("frame %d: got %d packets, want %d", i, len(ps), len(x.Want))
+		}
+		for j := range ps {
+			if !bytes.Equal(ps[j], x.Want[j]) {
+				t.Errorf("frame %d: packet %d: got %x, want %x", i, j, ps[j], x.Want[j])
+			}
+		}
+	}
+	s := dx.Stats()
+	if len(s) != 1 || s[0].Frames != 5 || s[0].Packets != 5 || s[0].Discarded != 0 {
+		t.Errorf("unexpected stats: %+v", s)
+	}
+}
+
+func TestDemuxFirstHeaderPointer(t *testing.T) {
+	var (
+		a = testSpacePacket(1, 22)
+		b = testSpacePacket(2, 16)
+		z = testSpacePacket(idleApid, 10)
+	)
+	dx := testDemux(t)
+
+	// the packet before the first header of the first frame is discarded
+	f, ps, err := dx.Push(testFrame(1, 0, 10, append(make([]byte, 10), a...)))
+	if err != nil || f.Packets != 1 || !bytes.Equal(ps[0], a) {
+		t.Fatalf("first frame: got %d packets (%v)", len(ps), err)
+	}
+	// idle packets are counted as fills, not given
+	if _, ps, err = dx.Push(testFrame(1, 1, 0, append(append([]byte(nil), b...), z...))); err != nil || len(ps) != 1 {
+		t.Fatalf("second frame: got %d packets (%v)", len(ps), err)
+	}
+	// a pointer after the end of the data resynchronizes the channel
+	f, ps, err = dx.Push(testFrame(1, 2, 40, a))
+	if !errors.Is(err, ErrPointer) || f == nil || len(ps) != 0 {
+		t.Fatalf("invalid pointer: got %d packets (%v)", len(ps), err)
+	}
+	if _, ps, _ = dx.Push(testFrame(1, 3, pointerNoHead, a)); len(ps) != 0 {
+		t.Fatalf("frame without header after an invalid pointer: got %d packets", len(ps))
+	}
+	// idle frames are not demultiplexed
+	if f, ps, err = dx.Push(testFrame(1, 4, pointerIdle, a)); err != nil || !f.Idle() || len(ps) != 0 {
+		t.Fatalf("idle frame: got %d packets (%v)", len(ps), err)
+	}
+	s := dx.Stats()[0]
+	want := FrameStats{
+		Channel:   1,
+		Frames:    5,
+		Idle:      1,
+		Packets:   2,
+		Fills:     1,
+		Errors:    1,
+		Discarded: 10 + 6 + 32,
+	}
+	if s != want {
+		t.Errorf("got %+v, want %+v", s, want)
+	}
+}
+
+func TestDemuxChannelGaps(t *testing.T) {
+	var (
+		a = testSpacePacket(1, 48)
+		b = testSpacePacket(2, 16)
+		z = testSpacePacket(idleApid, 16)
+	)
+	stream := append(append([]byte(nil), a...), b...)
+	other := append(append([]byte(nil), b...), z...)
+
+	dx := testDemux(t)
+	data := []struct {
+		Channel int
+		Counter uint32
+		Pointer int
+		Data    []byte
+		Missing uint32
+		Packets int
+	}{
+		{Channel: 1, Counter: 0xFFFFFE, Pointer: 0, Data: stream[:32]},
+		{Channel: 2, Counter: 7, Pointer: 0, Data: other, Packets: 1},
+		// counter wraps around without gap
+		{Channel: 1, Counter: 0xFFFFFF, Pointer: 16, Data: stream[32:], Packets: 2},
+		{Channel: 1, Counter: 0, Pointer: 0, Data: stream[:32]},
+		{Channel: 2, Counter: 8, Pointer: 0, Data: other, Packets: 1},
+		// the packet started before the gap is lost
+		{Channel: 1, Counter: 3, Pointer: 16, Data: stream[32:], Missing: 2, Packets: 1},
+	}
+	for i, x := range data {
+		f, ps, err := dx.Push(testFrame(x.Channel, x.Counter, x.Pointer, x.Data))
+		if err != nil {
+			t.Fatalf("frame %d: unexpected error: %s", i, err)
+		}
+		if f.Channel != x.Channel || f.Counter != x.Counter {
+			t.Errorf("frame %d: got VC %d (%d), want VC %d (%d)", i, f.Channel, f.Counter, x.Channel, x.Counter)
+		}
+		if f.Missing != x.Missing {
+			t.Errorf("frame %d: got %d missing frames, want %d", i, f.Missing, x.Missing)
+		}
+		if f.Packets != x.Packets || len(ps) != x.Packets {
+			t.Errorf("frame %d: got %d packets, want %d", i, len(ps), x.Packets)
+		}
+	}
+	s := dx.Stats()
+	if len(s) != 2 {
+		t.Fatalf("got %d channels, want 2", len(s))
+	}
+	if s[0].Channel != 1 || s[0].Gaps != 1 || s[0].Missing != 2 || s[0].Discarded != 48 {
+		t.Errorf("VC 1: unexpected stats %+v", s[0])
+	}
+	if s[1].Channel != 2 || s[1].Gaps != 0 || s[1].Packets != 2 || s[1].Fills != 2 {
+		t.Errorf("VC 2: unexpected stats %+v", s[1])
+	}
+}
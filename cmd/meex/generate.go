@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/midbel/cli"
+)
+
+const HRDLSyncWord = 0xf82e3553
+
+var generateCommand = &cli.Command{
+	Usage: "generate [-k type] [-i ids] [-n count] [-r rate] [-t time] [-l latency] [-z size] [-p payload] [-q sequence] [-g gap] [-o origin] [-y playback-origin] [-seed seed] <file>",
+	Alias: []string{"gen"},
+	Short: "generate synthetic packets into a RT file",
+	Run:   runGenerate,
+}
+
+type EncoderFunc func(id, seq int, when time.Time, payload []byte) ([]byte, error)
+
+type Generator struct {
+	Ids      []int
+	Rate     time.Duration
+	Start    time.Time
+	Latency  time.Duration
+	Size     int
+	Payload  string
+	Sequence int
+	Gap      float64
+	Origin   uint8
+	Playback int
+
+	rand *rand.Rand
+}
+
+func (g *Generator) Generate(w io.Writer, n int, e EncoderFunc) (int, error) {
+	seqs := make(map[int]int)
+	for _, i := range g.Ids {
+		seqs[i] = g.Sequence
+	}
+	var count int
+	for i := 0; i < n; i++ {
+		when := g.Start.Add(time.Duration(i) * g.Rate)
+		for _, id := range g.Ids {
+			seq := seqs[id]
+			for g.Gap > 0 && g.rand.Float64()*100 < g.Gap {
+				seq++
+			}
+			bs, err := e(id, seq, when, g.payload(seq))
+			if err != nil {
+				return count, err
+			}
+			if _, err := w.Write(bs); err != nil {
+				return count, err
+			}
+			seqs[id] = seq + 1
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (g *Generator) payload(seq int) []byte {
+	bs := make([]byte, g.Size)
+	switch g.Payload {
+	case "random":
+		g.rand.Read(bs)
+	case "counter":
+		for i := range bs {
+			bs[i] = byte(seq + i)
+		}
+	}
+	return bs
+}
+
+func EncodeTM(latency time.Duration) EncoderFunc {
+	return func(id, seq int, when time.Time, payload []byte) ([]byte, error) {
+		size := PTHHeaderLen + CCSDSHeaderLen + ESAHeaderLen + len(payload)
+		p := PTHHeader{
+			Size:      uint32(size - 4),
+			Type:      0x09,
+			Reception: when.Add(latency),
+		}
+		c := CCSDSHeader{
+			Version:  0x0800 | uint16(id&0x07FF),
+			Fragment: 0xC000 | uint16(seq&0x3FFF),
+			Length:   uint16(ESAHeaderLen + len(payload) - 1),
+		}
+		e := ESAHeader{
+			Acquisition: when,
+			Info:        uint8(PayloadHk),
+		}
+		bs := make([]byte, 0, size)
+		for _, m := range []interface{ MarshalBinary() ([]byte, error) }{&p, &c, &e} {
+			vs, err := m.MarshalBinary()
+			if err != nil {
+				return nil, err
+			}
+			bs = append(bs, vs...)
+		}
+		return append(bs, payload...), nil
+	}
+}
+
+func EncodePD() EncoderFunc {
+	return func(id, _ int, when time.Time, payload []byte) ([]byte, error) {
+		u := UMIHeader{
+			State:       StateNewValue,
+			Type:        BinaryN,
+			Acquisition: when,
+			Len:         uint16(len(payload)),
+		}
+		if len(payload) == 0 {
+			payload, u.Type, u.Len = make([]byte, 4), Int32, 4
+			binary.BigEndian.PutUint32(payload, uint32(when.Unix()))
+		}
+		u.Size = uint32(UMIHeaderLen - 4 + len(payload))
+		binary.BigEndian.PutUint16(u.Code[:], uint16(id>>32))
+		binary.BigEndian.PutUint32(u.Code[2:], uint32(id))
+
+		bs, err := u.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		return append(bs, payload...), nil
+	}
+}
+
+// EncodeVMU encodes VMU packets. When playback is not negative, it is used as
+// the origin of the VMU header and the packets are seen as playback.
+func EncodeVMU(origin uint8, playback int, latency time.Duration) EncoderFunc {
+	return func(id, seq int, when time.Time, payload []byte) ([]byte, error) {
+		channel := VMUChannel(id)
+		c := VMUCommonHeader{
+			Origin:  origin,
+			AcqTime: when.Sub(GPS),
+			AuxTime: when.Sub(GPS),
+			Counter: uint32(seq),
+		}
+		copy(c.UPI[:], fmt.Sprintf("SYNTHETIC_%s", channel))
+		var data []byte
+		switch channel {
+		case ChannelVic1, ChannelVic2:
+			c.Property = 2 << 4
+			i := Image{
+				VMUCommonHeader: &c,
+				VMUImageHeader:  &VMUImageHeader{Pixels: uint32(len(payload))},
+			}
+			data, _ = i.MarshalBinary()
+		case ChannelLRSD:
+			c.Property = 1 << 4
+			t := Table{VMUCommonHeader: &c}
+			data, _ = t.MarshalBinary()
+		default:
+			return nil, fmt.Errorf("unsupported VMU channel %d", id)
+		}
+		data = append(data, payload...)
+
+		size := HRDLHeaderLen + VMUHeaderLen + len(data) + 4
+		h := HRDLHeader{
+			Size:        uint32(size - 4),
+			Channel:     uint8(channel),
+			Acquisition: when,
+			Reception:   when.Add(latency),
+		}
+		v := VMUHeader{
+			Word:        HRDLSyncWord,
+			Size:        uint32(VMUHeaderLen - 8 + len(data)),
+			Origin:      origin,
+			Channel:     channel,
+			Sequence:    uint32(seq),
+			Acquisition: when,
+		}
+		if playback >= 0 {
+			v.Origin = uint8(playback)
+		}
+		bs, _ := h.MarshalBinary()
+		vs, _ := v.MarshalBinary()
+		bs = append(append(bs, vs...), data...)
+
+		var sum uint32
+		for _, b := range bs[HRDLHeaderLen+8:] {
+			sum += uint32(b)
+		}
+		bs = append(bs, 0, 0, 0, 0)
+		binary.LittleEndian.PutUint32(bs[len(bs)-4:], sum)
+		return bs, nil
+	}
+}
+
+func runGenerate(cmd *cli.Command, args []string) error {
+	var g Generator
+	kind := cmd.Flag.String("k", "", "packet type")
+	ids := cmd.Flag.String("i", "", "packet ids")
+	count := cmd.Flag.Int("n", 1000, "packets per id")
+	start := cmd.Flag.String("t", "", "start time")
+	origin := cmd.Flag.Uint("o", 0, "VMU origin")
+	cmd.Flag.IntVar(&g.Playback, "y", -1, "VMU playback origin")
+	var seed Seed
+	cmd.Flag.Var(&seed, "seed", "random seed")
+	cmd.Flag.DurationVar(&g.Rate, "r", time.Second, "rate")
+	cmd.Flag.DurationVar(&g.Latency, "l", 0, "reception latency")
+	cmd.Flag.IntVar(&g.Size, "z", 64, "payload size")
+	cmd.Flag.StringVar(&g.Payload, "p", "zero", "payload")
+	cmd.Flag.IntVar(&g.Sequence, "q", 0, "first sequence counter")
+	cmd.Flag.Float64Var(&g.Gap, "g", 0, "percent of skipped sequence counters")
+	if err := cmd.Flag.Parse(args); err != nil {
+		return err
+	}
+	g.rand, g.Origin = seed.Rand(), uint8(*origin)
+
+	f, err := Lookup(*kind)
+	if err != nil {
+		return err
+	}
+	if f.Encoder == nil {
+		return fmt.Errorf("packet type %s can not be generated", f.Name)
+	}
+	encode := f.Encoder(&g)
+
+	switch g.Payload {
+	case "zero", "random", "counter":
+	default:
+		return fmt.Errorf("unsupported payload %s", g.Payload)
+	}
+	for _, s := range strings.Split(*ids, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		i, err := strconv.ParseInt(s, 0, 64)
+		if err != nil {
+			return fmt.Errorf("invalid id %s", s)
+		}
+		g.Ids = append(g.Ids, int(i))
+	}
+	if len(g.Ids) == 0 {
+		return fmt.Errorf("no packet ids provided")
+	}
+	if *start == "" {
+		g.Start = time.Now().UTC().Truncate(time.Second)
+	} else {
+		t, err := time.Parse(time.RFC3339, *start)
+		if err != nil {
+			return err
+		}
+		g.Start = t.UTC()
+	}
+
+	file := cmd.Flag.Arg(0)
+	if d, f := filepath.Split(file); f == "" {
+		file = filepath.Join(d, "generate.dat")
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil && !os.IsExist(err) {
+		return err
+	}
+	fd, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	w := bufio.NewWriter(fd)
+	n, err := g.Generate(w, *count, encode)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		os.Remove(file)
+		return err
+	}
+	log.Printf("%d packets generated into %s", n, file)
+	return nil
+}
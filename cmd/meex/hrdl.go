@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// HRDLError is the error word set by the HRDL receiver in front of each
+// packet. Each bit reports a distinct condition detected on the link; the bits
+// are named after their position (bit0 being the least significant one).
+type HRDLError uint16
+
+func (e HRDLError) Flags() []string {
+	var vs []string
+	for i := uint(0); i < 16; i++ {
+		if e&(1<<i) != 0 {
+			vs = append(vs, fmt.Sprintf("bit%d", i))
+		}
+	}
+	return vs
+}
+
+func (e HRDLError) String() string {
+	if e == 0 {
+		return "-"
+	}
+	return strings.Join(e.Flags(), "|")
+}
+
+func (h *HRDLHeader) Errors() HRDLError {
+	return HRDLError(h.Error)
+}
+
+// ErrorFlags returns the names of the error conditions of the packet. The
+// VMU checksum mismatch is only reported when checksum is true.
+func (v *VMUPacket) ErrorFlags(checksum bool) []string {
+	vs := v.HRH.Errors().Flags()
+	if checksum && v.Sum != v.Control {
+		vs = append(vs, "vmu-checksum")
+	}
+	return vs
+}
+
+type ErrorRun struct {
+	Channel VMUChannel
+	Origin  uint8
+	Starts  time.Time
+	Ends    time.Time
+	Count   int
+	Flags   map[string]int
+}
+
+func (r *ErrorRun) Duration() time.Duration {
+	return r.Ends.Sub(r.Starts)
+}
+
+func (r *ErrorRun) String() string {
+	vs := make([]string, 0, len(r.Flags))
+	for f, n := range r.Flags {
+		vs = append(vs, fmt.Sprintf("%s:%d", f, n))
+	}
+	sort.Strings(vs)
+	return strings.Join(vs, ",")
+}
+
+type errorKey struct {
+	Channel VMUChannel
+	Origin  uint8
+}
+
+// ErrorTracker groups consecutive errored VMU packets of the same channel and
+// origin into runs.
+type ErrorTracker struct {
+	Checksum bool
+
+	runs   map[errorKey]*ErrorRun
+	counts map[errorKey]map[string]uint64
+}
+
+func NewErrorTracker(checksum bool) *ErrorTracker {
+	return &ErrorTracker{
+		Checksum: checksum,
+		runs:     make(map[errorKey]*ErrorRun),
+		counts:   make(map[errorKey]map[string]uint64),
+	}
+}
+
+// Update returns the run of errors closed by the packet, if any.
+func (t *ErrorTracker) Update(v *VMUPacket) *ErrorRun {
+	k := errorKey{Channel: v.VMU.Channel, Origin: v.VMU.Origin}
+	when := v.Timestamp()
+	flags := v.ErrorFlags(t.Checksum)
+
+	r := t.runs[k]
+	if len(flags) == 0 {
+		delete(t.runs, k)
+		return r
+	}
+	if t.counts[k] == nil {
+		t.counts[k] = make(map[string]uint64)
+	}
+	if r == nil {
+		r = &ErrorRun{
+			Channel: k.Channel,
+			Origin:  k.Origin,
+			Starts:  when,
+			Flags:   make(map[string]int),
+		}
+		t.runs[k] = r
+	}
+	r.Ends = when
+	r.Count++
+	for _, f := range flags {
+		r.Flags[f]++
+		t.counts[k][f]++
+	}
+	return nil
+}
+
+func (t *ErrorTracker) Flush() []*ErrorRun {
+	vs := make([]*ErrorRun, 0, len(t.runs))
+	for _, r := range t.runs {
+		vs = append(vs, r)
+	}
+	sort.Slice(vs, func(i, j int) bool { return vs[i].Starts.Before(vs[j].Starts) })
+	t.runs = make(map[errorKey]*ErrorRun)
+	return vs
+}
+
+type ErrorCount struct {
+	Channel VMUChannel
+	Origin  uint8
+	Flag    string
+	Count   uint64
+}
+
+func (t *ErrorTracker) Counts() []ErrorCount {
+	var vs []ErrorCount
+	for k, fs := range t.counts {
+		for f, n := range fs {
+			vs = append(vs, ErrorCount{Channel: k.Channel, Origin: k.Origin, Flag: f, Count: n})
+		}
+	}
+	sort.Slice(vs, func(i, j int) bool {
+		if vs[i].Channel != vs[j].Channel {
+			return vs[i].Channel < vs[j].Channel
+		}
+		if vs[i].Origin != vs[j].Origin {
+			return vs[i].Origin < vs[j].Origin
+		}
+		return vs[i].Flag < vs[j].Flag
+	})
+	return vs
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/midbel/cli"
+)
+
+var latencyCommand = &cli.Command{
+	Usage: "latency [-k type] [-b bucket] [-l lateness] [-r threshold] [-e edges] [-x factor] [-m floor] [-g gps-time] [-j jobs] <file...>",
+	Alias: []string{"lag"},
+	Short: "report reception latency distribution and spikes",
+	Run:   runLatency,
+}
+
+// latencyGamma is the ratio between the bounds of the bins of the latency
+// sketch: percentiles are given with a relative error of 1%.
+const latencyGamma = 1.02
+
+// Latency summarizes the latency of packets. The values are not kept but
+// counted in logarithmic bins, the percentiles being estimated from them.
+type Latency struct {
+	Key  string
+	Mode string
+	When time.Time
+
+	Min time.Duration
+	Max time.Duration
+	Sum time.Duration
+
+	count int
+	zero  int
+	pos   map[int]int
+	neg   map[int]int
+	edges []time.Duration
+	hist  []int
+}
+
+func NewLatency(edges []time.Duration) *Latency {
+	return &Latency{
+		pos:   make(map[int]int),
+		neg:   make(map[int]int),
+		edges: edges,
+		hist:  make([]int, len(edges)+1),
+	}
+}
+
+func (l *Latency) Count() int {
+	return l.count
+}
+
+func (l *Latency) Add(d time.Duration) {
+	if l.count == 0 || d < l.Min {
+		l.Min = d
+	}
+	if l.count == 0 || d > l.Max {
+		l.Max = d
+	}
+	l.Sum += d
+	l.count++
+
+	switch {
+	case d > 0:
+		l.pos[latencyBin(d)]++
+	case d < 0:
+		l.neg[latencyBin(-d)]++
+	default:
+		l.zero++
+	}
+	if l.hist != nil {
+		i := sort.Search(len(l.edges), func(i int) bool { return d < l.edges[i] })
+		l.hist[i]++
+	}
+}
+
+func latencyBin(d time.Duration) int {
+	return int(math.Ceil(math.Log(float64(d)) / math.Log(latencyGamma)))
+}
+
+func latencyValue(i int) time.Duration {
+	return time.Duration(2 * math.Pow(latencyGamma, float64(i)) / (latencyGamma + 1))
+}
+
+func (l *Latency) Mean() time.Duration {
+	if l.count == 0 {
+		return 0
+	}
+	return l.Sum / time.Duration(l.count)
+}
+
+// Percentile returns the latency under which q percent of the values are
+// found (nearest rank), estimated from the bins of the sketch.
+func (l *Latency) Percentile(q float64) time.Duration {
+	if l.count == 0 {
+		return 0
+	}
+	rank := int(q/100*float64(l.count)+0.5) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	d := l.Max
+	if v, ok := l.rank(rank); ok {
+		d = v
+	}
+	if d < l.Min {
+		d = l.Min
+	}
+	if d > l.Max {
+		d = l.Max
+	}
+	return d.Round(time.Microsecond)
+}
+
+func (l *Latency) rank(rank int) (time.Duration, bool) {
+	bins := func(m map[int]int) []int {
+		is := make([]int, 0, len(m))
+		for i := range m {
+			is = append(is, i)
+		}
+		sort.Ints(is)
+		return is
+	}
+	ns := bins(l.neg)
+	for j := len(ns) - 1; j >= 0; j-- {
+		if rank -= l.neg[ns[j]]; rank < 0 {
+			return -latencyValue(ns[j]), true
+		}
+	}
+	if rank -= l.zero; rank < 0 {
+		return 0, true
+	}
+	for _, i := range bins(l.pos) {
+		if rank -= l.pos[i]; rank < 0 {
+			return latencyValue(i), true
+		}
+	}
+	return 0, false
+}
+
+// Histogram returns the count of values lower than each edge. The last count
+// holds the values greater or equal than the last edge.
+func (l *Latency) Histogram() []int {
+	return l.hist
+}
+
+type latencyKey struct {
+	Key  string
+	Mode string
+}
+
+// LatencyTracker computes the latency of packets per key, mode and bucket.
+// Like a Counter, the buckets stay open until the latest packet seen is
+// Lateness after their end.
+type LatencyTracker struct {
+	Lateness time.Duration
+
+	bucket Bucket
+	edges  []time.Duration
+	stats  map[latencyKey]map[time.Time]*Latency
+	latest time.Time
+	mark   time.Time
+}
+
+func NewLatencyTracker(b Bucket, edges []time.Duration) *LatencyTracker {
+	return &LatencyTracker{
+		Lateness: DefaultLateness,
+		bucket:   b,
+		edges:    edges,
+		stats:    make(map[latencyKey]map[time.Time]*Latency),
+	}
+}
+
+// Add records the latency of p. It returns the buckets closed by p.
+func (t *LatencyTracker) Add(p Packet, mode string) []*Latency {
+	k := latencyKey{Key: defaultPacketKey(p), Mode: mode}
+	var when time.Time
+	if !t.bucket.IsZero() {
+		when = t.bucket.Truncate(p.Timestamp())
+	}
+	ls := t.stats[k]
+	if ls == nil {
+		ls = make(map[time.Time]*Latency)
+		t.stats[k] = ls
+	}
+	l := ls[when]
+	if l == nil {
+		l = NewLatency(t.edges)
+		l.Key, l.Mode, l.When = k.Key, k.Mode, when
+		ls[when] = l
+	}
+	l.Add(p.Reception().Sub(p.Timestamp()))
+
+	if t.bucket.IsZero() || !p.Timestamp().After(t.latest) {
+		return nil
+	}
+	t.latest = p.Timestamp()
+	mark := t.bucket.Truncate(t.latest.Add(-t.Lateness))
+	if !mark.After(t.mark) {
+		return nil
+	}
+	t.mark = mark
+	return t.close(func(l *Latency) bool { return t.bucket.Next(l.When).After(mark) })
+}
+
+func (t *LatencyTracker) Flush() []*Latency {
+	return t.close(nil)
+}
+
+// close returns the open buckets for which keep is false.
+func (t *LatencyTracker) close(keep func(*Latency) bool) []*Latency {
+	var vs []*Latency
+	for k, ls := range t.stats {
+		for w, l := range ls {
+			if keep != nil && keep(l) {
+				continue
+			}
+			vs = append(vs, l)
+			delete(ls, w)
+		}
+		if len(ls) == 0 {
+			delete(t.stats, k)
+		}
+	}
+	sort.Slice(vs, func(i, j int) bool {
+		if !vs[i].When.Equal(vs[j].When) {
+			return vs[i].When.Before(vs[j].When)
+		}
+		if vs[i].Key != vs[j].Key {
+			return vs[i].Key < vs[j].Key
+		}
+		return vs[i].Mode < vs[j].Mode
+	})
+	return vs
+}
+
+type Spike struct {
+	Key      string
+	Mode     string
+	Starts   time.Time
+	Ends     time.Time
+	Count    int
+	Peak     time.Duration
+	Baseline time.Duration
+}
+
+// SpikeDetector reports runs of packets whose latency is greater than Factor
+// times the moving average of the latency of their key and greater than
+// Floor.
+type SpikeDetector struct {
+	Factor float64
+	Floor  time.Duration
+
+	average map[latencyKey]float64
+	open    map[latencyKey]*Spike
+}
+
+func NewSpikeDetector(factor float64, floor time.Duration) *SpikeDetector {
+	return &SpikeDetector{
+		Factor:  factor,
+		Floor:   floor,
+		average: make(map[latencyKey]float64),
+		open:    make(map[latencyKey]*Spike),
+	}
+}
+
+// Update returns the spike ended by p, if any.
+func (s *SpikeDetector) Update(p Packet, mode string) *Spike {
+	const alpha = 0.1
+
+	k := latencyKey{Key: defaultPacketKey(p), Mode: mode}
+	d := p.Reception().Sub(p.Timestamp())
+	avg, ok := s.average[k]
+	if !ok {
+		s.average[k] = float64(d)
+		return nil
+	}
+	sp := s.open[k]
+	if d > s.Floor && float64(d) > avg*s.Factor {
+		if sp == nil {
+			sp = &Spike{
+				Key:      k.Key,
+				Mode:     k.Mode,
+				Starts:   p.Timestamp(),
+				Baseline: time.Duration(avg),
+			}
+			s.open[k] = sp
+		}
+		sp.Ends = p.Timestamp()
+		sp.Count++
+		if d > sp.Peak {
+			sp.Peak = d
+		}
+		return nil
+	}
+	s.average[k] = avg + alpha*(float64(d)-avg)
+	delete(s.open, k)
+	return sp
+}
+
+func (s *SpikeDetector) Flush() []*Spike {
+	vs := make([]*Spike, 0, len(s.open))
+	for _, sp := range s.open {
+		vs = append(vs, sp)
+	}
+	sort.Slice(vs, func(i, j int) bool { return vs[i].Starts.Before(vs[j].Starts) })
+	s.open = make(map[latencyKey]*Spike)
+	return vs
+}
+
+func parseEdges(v string) ([]time.Duration, error) {
+	var es []time.Duration
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid histogram edge %s", s)
+		}
+		es = append(es, d)
+	}
+	sort.Slice(es, func(i, j int) bool { return es[i] < es[j] })
+	return es, nil
+}
+
+func runLatency(cmd *cli.Command, args []string) error {
+	var (
+		kind   Kind
+		bucket Bucket
+	)
+	cmd.Flag.Var(&kind, "k", "packet type")
+	cmd.Flag.Var(&bucket, "b", "bucket")
+	lateness := cmd.Flag.Duration("l", DefaultLateness, "delay before closing a bucket")
+	threshold := cmd.Flag.Duration("r", 0, "playback threshold")
+	edges := cmd.Flag.String("e", "", "histogram edges")
+	factor := cmd.Flag.Float64("x", 5, "spike factor")
+	floor := cmd.Flag.Duration("m", time.Second, "spike floor")
+	toGPS := cmd.Flag.Bool("g", false, "gps time")
+	jobs := cmd.Flag.Int("j", 1, "parallel jobs")
+	if err := cmd.Flag.Parse(args); err != nil {
+		return err
+	}
+	es, err := parseEdges(*edges)
+	if err != nil {
+		return err
+	}
+
+	var delta time.Duration
+	if *toGPS {
+		delta = -GPS.Sub(UNIX)
+	}
+
+	const (
+		row   = "%23s | %20s | %-8s | %8d | %12s | %12s | %12s | %12s | %12s | %12s"
+		spike = "%20s | %-8s | %s | %s | %8d | %12s | %12s"
+	)
+	printLatency := func(l *Latency) {
+		if l == nil {
+			return
+		}
+		when := "-"
+		if !l.When.IsZero() {
+			when = bucket.Format(l.When.Add(delta))
+		}
+		log.Printf(row, when, l.Key, l.Mode, l.Count(), l.Min, l.Mean(), l.Percentile(50), l.Percentile(90), l.Percentile(99), l.Max)
+		if len(es) == 0 {
+			return
+		}
+		hs := l.Histogram()
+		vs := make([]string, len(hs))
+		for i, n := range hs {
+			if i < len(es) {
+				vs[i] = fmt.Sprintf("<%s:%d", es[i], n)
+			} else {
+				vs[i] = fmt.Sprintf(">=%s:%d", es[i-1], n)
+			}
+		}
+		log.Printf("%23s | %20s | %-8s | %s", "", l.Key, l.Mode, strings.Join(vs, " "))
+	}
+	var spikes int
+	printSpike := func(s *Spike) {
+		if s == nil {
+			return
+		}
+		spikes++
+		f, t := s.Starts.Add(delta).Format(TimeFormat), s.Ends.Add(delta).Format(TimeFormat)
+		log.Printf(spike, s.Key, s.Mode, f, t, s.Count, s.Peak, s.Baseline)
+	}
+
+	ctx, cancel := Interrupt()
+	defer cancel()
+
+	var total int
+	tracker := NewLatencyTracker(bucket, es)
+	tracker.Lateness = *lateness
+	detector := NewSpikeDetector(*factor, *floor)
+	walker := NewWalker(ctx, cmd.Flag.Args(), kind.Decod)
+	defer walker.Close()
+	walker.Jobs = *jobs
+	for p := range walker.Walk() {
+		if p.Error() || p.Reception().IsZero() {
+			continue
+		}
+		total++
+		mode := PacketMode(p, *threshold)
+		for _, l := range tracker.Add(p, mode) {
+			printLatency(l)
+		}
+		printSpike(detector.Update(p, mode))
+	}
+	for _, l := range tracker.Flush() {
+		printLatency(l)
+	}
+	for _, s := range detector.Flush() {
+		printSpike(s)
+	}
+	log.Printf("%d packets, %d latency spikes", total, spikes)
+	return walker.Err()
+}
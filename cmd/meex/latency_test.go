@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLatencyTrackerLateness(t *testing.T) {
+	tracker := NewLatencyTracker(Bucket{Width: time.Hour}, nil)
+	tracker.Lateness = 30 * time.Minute
+
+	var closed []*Latency
+	for i, d := range []time.Duration{
+		10 * time.Minute,
+		70 * time.Minute,
+		// late but its bucket is still open
+		50 * time.Minute,
+		80 * time.Minute,
+		// closes the first bucket
+		95 * time.Minute,
+		// too late: a new bucket is started
+		40 * time.Minute,
+	} {
+		p := testVMUPacket(t, ChannelVic1, i, testTime.Add(d))
+		closed = append(closed, tracker.Add(p, "realtime")...)
+	}
+	if len(closed) != 1 || !closed[0].When.Equal(testTime) || closed[0].Count() != 2 {
+		t.Fatalf("unexpected closed buckets: %+v", closed)
+	}
+	want := []struct {
+		When  time.Duration
+		Count int
+	}{
+		{When: 0, Count: 1},
+		{When: time.Hour, Count: 3},
+	}
+	ls := tracker.Flush()
+	if len(ls) != len(want) {
+		t.Fatalf("got %d buckets, want %d", len(ls), len(want))
+	}
+	for i, l := range ls {
+		if !l.When.Equal(testTime.Add(want[i].When)) || l.Count() != want[i].Count {
+			t.Errorf("bucket %d: got %s %d, want %s %d", i, l.When.Sub(testTime), l.Count(), want[i].When, want[i].Count)
+		}
+	}
+}
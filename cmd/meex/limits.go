@@ -0,0 +1,352 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/midbel/cli"
+)
+
+var limitsCommand = &cli.Command{
+	Usage: "limits [-k type] [-d definitions] [-l limits] [-a archive] [-f from] [-t to] [-g gps-time] [-j jobs] [file...]",
+	Short: "report parameters out of their soft and hard limits",
+	Run:   runLimits,
+}
+
+type Level int
+
+const (
+	Nominal Level = iota
+	SoftLow
+	SoftHigh
+	HardLow
+	HardHigh
+)
+
+func (l Level) String() string {
+	switch l {
+	case SoftLow:
+		return "soft-low"
+	case SoftHigh:
+		return "soft-high"
+	case HardLow:
+		return "hard-low"
+	case HardHigh:
+		return "hard-high"
+	default:
+		return "nominal"
+	}
+}
+
+// Limit holds the soft and hard ranges of a parameter. For PD values, Name is
+// the UMI code as printed by list (eg: 0x000000000102).
+type Limit struct {
+	Name     string
+	SoftLow  float64
+	SoftHigh float64
+	HardLow  float64
+	HardHigh float64
+
+	calibrate Calibrator
+}
+
+func (i *Limit) Check(v float64) Level {
+	switch {
+	case v < i.HardLow:
+		return HardLow
+	case v > i.HardHigh:
+		return HardHigh
+	case v < i.SoftLow:
+		return SoftLow
+	case v > i.SoftHigh:
+		return SoftHigh
+	default:
+		return Nominal
+	}
+}
+
+// LoadLimits reads limits with the columns: name, soft-low, soft-high,
+// hard-low, hard-high and an optional calibration applied to PD values.
+// Empty bounds are not checked.
+func LoadLimits(file string) (map[string]*Limit, error) {
+	r, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	rs := csv.NewReader(r)
+	rs.Comment = '#'
+	rs.FieldsPerRecord = -1
+	rs.TrimLeadingSpace = true
+
+	ls := make(map[string]*Limit)
+	for {
+		row, err := rs.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		if len(row) < 5 {
+			return nil, fmt.Errorf("%s: not enough fields for %s", file, row[0])
+		}
+		if row[0] == "name" {
+			continue
+		}
+		i := Limit{Name: row[0]}
+		bounds := []*float64{&i.SoftLow, &i.SoftHigh, &i.HardLow, &i.HardHigh}
+		for j, v := range bounds {
+			*v = math.NaN()
+			if s := strings.TrimSpace(row[j+1]); s != "" {
+				f, err := strconv.ParseFloat(s, 64)
+				if err != nil {
+					return nil, fmt.Errorf("%s: invalid limit %s for %s", file, s, i.Name)
+				}
+				*v = f
+			}
+		}
+		if math.IsNaN(i.HardLow) {
+			i.HardLow = math.Inf(-1)
+		}
+		if math.IsNaN(i.HardHigh) {
+			i.HardHigh = math.Inf(1)
+		}
+		if math.IsNaN(i.SoftLow) {
+			i.SoftLow = i.HardLow
+		}
+		if math.IsNaN(i.SoftHigh) {
+			i.SoftHigh = i.HardHigh
+		}
+		if len(row) > 5 {
+			c, err := ParseCalibration(row[5])
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s: %w", file, i.Name, err)
+			}
+			i.calibrate = c
+		}
+		ls[i.Name] = &i
+	}
+	return ls, nil
+}
+
+type Violation struct {
+	Name    string
+	Level   Level
+	Starts  time.Time
+	Ends    time.Time
+	Samples int
+	Worst   float64
+}
+
+func (v *Violation) Duration() time.Duration {
+	return v.Ends.Sub(v.Starts)
+}
+
+type LimitChecker struct {
+	limits map[string]*Limit
+	open   map[string]*Violation
+}
+
+func NewLimitChecker(ls map[string]*Limit) *LimitChecker {
+	return &LimitChecker{
+		limits: ls,
+		open:   make(map[string]*Violation),
+	}
+}
+
+// Check updates the state of the parameter and returns the violation that
+// ends with this sample, if any.
+func (c *LimitChecker) Check(name string, when time.Time, value interface{}) *Violation {
+	i, ok := c.limits[name]
+	if !ok {
+		return nil
+	}
+	f, err := toFloat(value)
+	if err != nil {
+		return nil
+	}
+	level := i.Check(f)
+
+	v := c.open[name]
+	if v != nil && v.Level == level {
+		v.Samples++
+		v.Ends = when
+		if math.Abs(f-i.center()) > math.Abs(v.Worst-i.center()) {
+			v.Worst = f
+		}
+		return nil
+	}
+	if v != nil {
+		v.Ends = when
+		delete(c.open, name)
+	}
+	if level != Nominal {
+		c.open[name] = &Violation{
+			Name:    name,
+			Level:   level,
+			Starts:  when,
+			Ends:    when,
+			Samples: 1,
+			Worst:   f,
+		}
+	}
+	return v
+}
+
+// Flush returns the violations still in progress at the end of the scan.
+func (c *LimitChecker) Flush() []*Violation {
+	vs := make([]*Violation, 0, len(c.open))
+	for _, v := range c.open {
+		vs = append(vs, v)
+	}
+	sort.Slice(vs, func(i, j int) bool { return vs[i].Starts.Before(vs[j].Starts) })
+	c.open = make(map[string]*Violation)
+	return vs
+}
+
+func (i *Limit) center() float64 {
+	lo, hi := i.SoftLow, i.SoftHigh
+	switch {
+	case math.IsInf(lo, 0) && math.IsInf(hi, 0):
+		return 0
+	case math.IsInf(lo, 0):
+		return hi
+	case math.IsInf(hi, 0):
+		return lo
+	default:
+		return (lo + hi) / 2
+	}
+}
+
+func runLimits(cmd *cli.Command, args []string) error {
+	var kind Kind
+	cmd.Flag.Var(&kind, "k", "packet type")
+	defs := cmd.Flag.String("d", "", "parameter definitions")
+	file := cmd.Flag.String("l", "", "limits")
+	archive := cmd.Flag.String("a", "", "archive directory")
+	from := cmd.Flag.String("f", "", "start time")
+	to := cmd.Flag.String("t", "", "end time")
+	toGPS := cmd.Flag.Bool("g", false, "gps time")
+	jobs := cmd.Flag.Int("j", 1, "parallel jobs")
+	if err := cmd.Flag.Parse(args); err != nil {
+		return err
+	}
+	ls, err := LoadLimits(*file)
+	if err != nil {
+		return err
+	}
+	var decom *Decommutator
+	if *defs != "" {
+		if decom, err = LoadParameters(*defs); err != nil {
+			return err
+		}
+	}
+	paths, fd, td, err := archivePaths(cmd.Flag.Args(), *archive, *from, *to)
+	if err != nil {
+		return err
+	}
+
+	var delta time.Duration
+	if *toGPS {
+		delta = -GPS.Sub(UNIX)
+	}
+	const row = "%-24s | %-9s | %s | %s | %12s | %6d | %s"
+	var count int
+	report := func(v *Violation) {
+		if v == nil {
+			return
+		}
+		count++
+		s, e := v.Starts.Add(delta).Format(TimeFormat), v.Ends.Add(delta).Format(TimeFormat)
+		log.Printf(row, v.Name, v.Level, s, e, v.Duration(), v.Samples, formatValue(v.Worst))
+	}
+
+	ctx, cancel := Interrupt()
+	defer cancel()
+
+	checker := NewLimitChecker(ls)
+	walker := NewWalker(ctx, paths, kind.Decod)
+	defer walker.Close()
+	walker.Jobs = *jobs
+	for p := range walker.Walk() {
+		if p.Error() {
+			continue
+		}
+		when := p.Timestamp()
+		if (!fd.IsZero() && when.Before(fd)) || (!td.IsZero() && !when.Before(td)) {
+			continue
+		}
+		switch p := p.(type) {
+		case *TMPacket:
+			if decom == nil {
+				continue
+			}
+			for _, v := range decom.Decom(p) {
+				report(checker.Check(v.Name, when, v.Eng))
+			}
+		case *PDPacket:
+			name := fmt.Sprintf("0x%x", p.UMI.Code[:])
+			i, ok := ls[name]
+			if !ok {
+				continue
+			}
+			v, err := p.Value()
+			if err != nil {
+				continue
+			}
+			if i.calibrate != nil {
+				if v, err = i.calibrate.Calibrate(v); err != nil {
+					continue
+				}
+			}
+			report(checker.Check(name, when, v))
+		}
+	}
+	for _, v := range checker.Flush() {
+		report(v)
+	}
+	log.Printf("%d limit violations found", count)
+	return walker.Err()
+}
+
+// archivePaths adds to paths the existing directories of the archive
+// between from and to (RFC3339). The archive is optional but requires both
+// times.
+func archivePaths(paths []string, archive, from, to string) ([]string, time.Time, time.Time, error) {
+	var fd, td time.Time
+	for _, t := range []struct {
+		value string
+		when  *time.Time
+	}{{from, &fd}, {to, &td}} {
+		if t.value == "" {
+			continue
+		}
+		w, err := time.Parse(time.RFC3339, t.value)
+		if err != nil {
+			return nil, fd, td, err
+		}
+		*t.when = w.UTC()
+	}
+	if archive == "" {
+		return paths, fd, td, nil
+	}
+	if fd.IsZero() || td.IsZero() {
+		return nil, fd, td, fmt.Errorf("archive requires start and end time")
+	}
+	for _, p := range ListPaths(archive, fd.Truncate(time.Hour), td) {
+		if i, err := os.Stat(p); err == nil && i.IsDir() {
+			paths = append(paths, p)
+		}
+	}
+	return paths, fd, td, nil
+}
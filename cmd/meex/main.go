@@ -26,6 +26,18 @@ var commands = []*cli.Command{
 	countCommand,
 	errCommand,
 	storeCommand,
+	manifestCommand,
+	degradeCommand,
+	generateCommand,
+	detectCommand,
+	framesCommand,
+	correlateCommand,
+	paramsCommand,
+	limitsCommand,
+	latencyCommand,
+	splitCommand,
+	reconcileCommand,
+	upiCommand,
 }
 
 const helpText = `{{.Name}} scan the HRDP archive to consolidate the USOC HRDP archive
@@ -42,8 +54,9 @@ Use {{.Name}} [command] -h for more information about its usage.
 `
 
 type Kind struct {
-	Decod Decoder
-	Sort  SortFunc
+	Family *Family
+	Decod  Decoder
+	Sort   SortFunc
 }
 
 func SortHRDIndex(ix []*Index) []*Index {
@@ -71,22 +84,26 @@ func SortTMIndex(ix []*Index) []*Index {
 }
 
 func (k *Kind) Set(v string) error {
-	switch strings.ToLower(v) {
-	default:
-		return fmt.Errorf("unrecognized packet decoder type")
+	switch v = strings.ToLower(v); v {
 	case "":
 		return fmt.Errorf("no packet type provided")
-	case "pd", "pp", "pdh":
-		k.Decod = DecodePD()
-	case "tm", "pth", "pt":
-		k.Decod = DecodeTM()
-		k.Sort = SortTMIndex
-	case "vmu":
-		k.Decod = DecodeVMU()
-		k.Sort = SortHRDIndex
-	case "hrd":
-		k.Decod = DecodeHRD()
+	case "auto", "detect":
+		k.Decod, k.Sort = DecodeAuto(), nil
+		return nil
 	}
+	var opts string
+	if i := strings.Index(v, ":"); i >= 0 {
+		v, opts = v[:i], v[i+1:]
+	}
+	f, err := Lookup(v)
+	if err != nil {
+		return err
+	}
+	d, err := f.DecoderWith(opts)
+	if err != nil {
+		return err
+	}
+	k.Family, k.Decod, k.Sort = f, d, f.Sort
 	return nil
 }
 
@@ -94,6 +111,15 @@ func (k *Kind) String() string {
 	return "packet decoder type"
 }
 
+// Decoder gives the decoder of k or, when no packet type was given, the
+// decoder detecting the packet type of each file.
+func (k *Kind) Decoder() Decoder {
+	if k.Decod == nil {
+		return DecodeAuto()
+	}
+	return k.Decod
+}
+
 func init() {
 	log.SetFlags(0)
 	log.SetOutput(os.Stdout)
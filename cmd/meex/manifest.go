@@ -0,0 +1,334 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/midbel/cli"
+	"github.com/midbel/xxh"
+)
+
+var manifestCommand = &cli.Command{
+	Usage: "manifest build [-k type] [-o file] <dir> | manifest verify [-k type] <manifest> <dir>",
+	Short: "build or verify the manifest of an archive tree",
+	Run:   runManifest,
+}
+
+const (
+	StateOk        = "ok"
+	StateModified  = "modified"
+	StateMissing   = "missing"
+	StateTruncated = "truncated"
+	StateExtra     = "extra"
+)
+
+type Entry struct {
+	File   string
+	Size   int64
+	Count  uint64
+	Starts time.Time
+	Ends   time.Time
+	SHA    string
+	XXH    string
+}
+
+func (e *Entry) record() []string {
+	return []string{
+		e.File,
+		strconv.FormatInt(e.Size, 10),
+		strconv.FormatUint(e.Count, 10),
+		formatTime(e.Starts),
+		formatTime(e.Ends),
+		e.SHA,
+		e.XXH,
+	}
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(time.RFC3339Nano)
+}
+
+func parseTime(s string) (time.Time, error) {
+	if s == "-" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339Nano, s)
+}
+
+func parseEntry(rs []string) (*Entry, error) {
+	if len(rs) != 7 {
+		return nil, fmt.Errorf("invalid manifest entry: %d fields (want 7)", len(rs))
+	}
+	var (
+		e   Entry
+		err error
+	)
+	e.File, e.SHA, e.XXH = rs[0], rs[5], rs[6]
+	if e.Size, err = strconv.ParseInt(rs[1], 10, 64); err != nil {
+		return nil, err
+	}
+	if e.Count, err = strconv.ParseUint(rs[2], 10, 64); err != nil {
+		return nil, err
+	}
+	if e.Starts, err = parseTime(rs[3]); err != nil {
+		return nil, err
+	}
+	if e.Ends, err = parseTime(rs[4]); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+func ReadManifest(file string) (map[string]*Entry, error) {
+	r, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	rs := csv.NewReader(r)
+	rs.Comma = '|'
+	rs.FieldsPerRecord = -1
+
+	es := make(map[string]*Entry)
+	for {
+		vs, err := rs.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		e, err := parseEntry(vs)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", file, err)
+		}
+		es[e.File] = e
+	}
+	return es, nil
+}
+
+func ManifestFiles(dir string) ([]string, error) {
+	var fs []string
+	err := filepath.Walk(dir, func(p string, i os.FileInfo, err error) error {
+		if err != nil || i.IsDir() {
+			return err
+		}
+		if !i.Mode().IsRegular() {
+			return nil
+		}
+		f, err := filepath.Rel(dir, p)
+		if err == nil {
+			fs = append(fs, filepath.ToSlash(f))
+		}
+		return err
+	})
+	sort.Strings(fs)
+	return fs, err
+}
+
+func EntryFile(dir, file string, d Decoder) (*Entry, error) {
+	r, err := os.Open(filepath.Join(dir, filepath.FromSlash(file)))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var (
+		e  = Entry{File: file}
+		s  = sha256.New()
+		x  = xxh.New64(0)
+		rs = io.TeeReader(r, io.MultiWriter(s, x))
+	)
+	if d == nil {
+		sc := Scan(rs)
+		for sc.Scan() {
+			e.Count++
+		}
+	} else {
+		for p := range NewReader(rs, d).Packets() {
+			e.Count++
+			if t := p.Timestamp(); e.Starts.IsZero() || t.Before(e.Starts) {
+				e.Starts = t
+			}
+			if t := p.Timestamp(); t.After(e.Ends) {
+				e.Ends = t
+			}
+		}
+	}
+	if _, err := io.Copy(ioutil.Discard, rs); err != nil {
+		return nil, err
+	}
+	i, err := r.Stat()
+	if err != nil {
+		return nil, err
+	}
+	e.Size = i.Size()
+	e.SHA = fmt.Sprintf("%x", s.Sum(nil))
+	e.XXH = fmt.Sprintf("%016x", x.Sum64())
+	return &e, nil
+}
+
+func runManifest(cmd *cli.Command, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("manifest: missing action (build, verify)")
+	}
+	switch args[0] {
+	case "build":
+		return runManifestBuild(cmd, args[1:])
+	case "verify", "check":
+		return runManifestVerify(cmd, args[1:])
+	default:
+		return fmt.Errorf("manifest: unsupported action %q", args[0])
+	}
+}
+
+func runManifestBuild(cmd *cli.Command, args []string) error {
+	var kind Kind
+	cmd.Flag.Var(&kind, "k", "packet type")
+	file := cmd.Flag.String("o", "", "manifest file")
+	if err := cmd.Flag.Parse(args); err != nil {
+		return err
+	}
+	dir := cmd.Flag.Arg(0)
+	fs, err := ManifestFiles(dir)
+	if err != nil {
+		return err
+	}
+	var w io.Writer = os.Stdout
+	if *file != "" {
+		f, err := os.Create(*file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	ws := csv.NewWriter(w)
+	ws.Comma = '|'
+
+	var size, count uint64
+	now := time.Now()
+	for _, f := range fs {
+		if abs, err := filepath.Abs(filepath.Join(dir, f)); err == nil && *file != "" {
+			if m, err := filepath.Abs(*file); err == nil && m == abs {
+				continue
+			}
+		}
+		e, err := EntryFile(dir, f, kind.Decod)
+		if err != nil {
+			return err
+		}
+		if err := ws.Write(e.record()); err != nil {
+			return err
+		}
+		size += uint64(e.Size)
+		count += e.Count
+	}
+	ws.Flush()
+	if err := ws.Error(); err != nil {
+		return err
+	}
+	if *file != "" {
+		log.Printf("%d files, %d packets (%dMB) in manifest (%s)", len(fs), count, size>>20, time.Since(now))
+	}
+	return nil
+}
+
+func runManifestVerify(cmd *cli.Command, args []string) error {
+	var kind Kind
+	cmd.Flag.Var(&kind, "k", "packet type")
+	if err := cmd.Flag.Parse(args); err != nil {
+		return err
+	}
+	es, err := ReadManifest(cmd.Flag.Arg(0))
+	if err != nil {
+		return err
+	}
+	if kind.Decod == nil {
+		// the times of the packets are only recorded when the manifest is
+		// built with a packet type, the same is needed to verify them.
+		for _, e := range es {
+			if !e.Starts.IsZero() || !e.Ends.IsZero() {
+				return fmt.Errorf("manifest: %s built with a packet type (use -k)", cmd.Flag.Arg(0))
+			}
+		}
+	}
+	dir := cmd.Flag.Arg(1)
+	fs, err := ManifestFiles(dir)
+	if err != nil {
+		return err
+	}
+	const row = "%-9s | %s"
+
+	var (
+		total  uint64
+		failed uint64
+		seen   = make(map[string]struct{})
+	)
+	for _, f := range fs {
+		if abs, err := filepath.Abs(filepath.Join(dir, f)); err == nil {
+			if m, err := filepath.Abs(cmd.Flag.Arg(0)); err == nil && m == abs {
+				continue
+			}
+		}
+		total++
+		seen[f] = struct{}{}
+		want, ok := es[f]
+		if !ok {
+			failed++
+			log.Printf(row, StateExtra, f)
+			continue
+		}
+		got, err := EntryFile(dir, f, kind.Decod)
+		if err != nil {
+			return err
+		}
+		if state := compareEntry(want, got); state != StateOk {
+			failed++
+			log.Printf(row, state, f)
+		}
+	}
+	var files []string
+	for f := range es {
+		if _, ok := seen[f]; !ok {
+			files = append(files, f)
+		}
+	}
+	sort.Strings(files)
+	for _, f := range files {
+		total++
+		failed++
+		log.Printf(row, StateMissing, f)
+	}
+	log.Printf("%d files verified, %d failed", total, failed)
+	if failed > 0 {
+		return fmt.Errorf("manifest: %d files failed verification", failed)
+	}
+	return nil
+}
+
+func compareEntry(want, got *Entry) string {
+	switch {
+	case got.Size < want.Size:
+		return StateTruncated
+	case got.Size != want.Size, got.SHA != want.SHA, got.XXH != want.XXH:
+		return StateModified
+	case got.Count != want.Count, !got.Starts.Equal(want.Starts), !got.Ends.Equal(want.Ends):
+		return StateModified
+	default:
+		return StateOk
+	}
+}
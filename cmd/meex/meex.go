@@ -4,6 +4,8 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -51,6 +53,49 @@ type HRPacket interface {
 	fmt.Stringer
 }
 
+// clonePacket copies p with the bytes it was decoded from so that it stays
+// valid once the file it was read from is released.
+func clonePacket(p Packet) Packet {
+	switch p := p.(type) {
+	case *VMUPacket:
+		c := *p
+		c.Payload = append([]byte(nil), p.Payload...)
+		return &c
+	case *Image:
+		c := *p
+		c.record, c.Payload = cloneRecord(p.record, p.Payload)
+		return &c
+	case *Table:
+		c := *p
+		c.record, c.Payload = cloneRecord(p.record, p.Payload)
+		return &c
+	case *TMPacket:
+		c := *p
+		c.Payload = append([]byte(nil), p.Payload...)
+		return &c
+	case *TCPacket:
+		c := *p
+		c.Payload = append([]byte(nil), p.Payload...)
+		return &c
+	case *PDPacket:
+		c := *p
+		c.Payload = append([]byte(nil), p.Payload...)
+		return &c
+	default:
+		return p
+	}
+}
+
+// cloneRecord copies the record of an HRD packet and gives its payload found
+// at the end of the copy.
+func cloneRecord(record, payload []byte) ([]byte, []byte) {
+	if record == nil {
+		return nil, append([]byte(nil), payload...)
+	}
+	r := append([]byte(nil), record...)
+	return r, r[len(r)-len(payload):]
+}
+
 type Decoder interface {
 	Decode([]byte) (Packet, error)
 }
@@ -63,21 +108,69 @@ type Info struct {
 	Sum      uint32    `json:"checksum"`
 	Context  string    `json:"context"`
 	Type     string    `json:"data"`
+	Service  int       `json:"service,omitempty"`
+	Subtype  int       `json:"subtype,omitempty"`
+	Source   int       `json:"source,omitempty"`
+	Mode     string    `json:"mode,omitempty"`
 }
 
 func (i *Info) String() string {
-	switch i.Type {
-	case "tm":
-		return fmt.Sprint(i.Id)
-	case "pp":
-		return fmt.Sprintf("%x", i.Id)
-	case "vmu":
-		return VMUChannel(i.Id).String()
-	case "hrd":
-		return fmt.Sprintf("%s-%x", i.Context, i.Id)
-	default:
+	f, err := Lookup(i.Type)
+	if err != nil || f.Format == nil {
 		return "invalid"
 	}
+	return f.Format(i)
+}
+
+// Service selects packets by PUS service type and, optionally, subtype (eg:
+// 5 or 5:1). A negative value matches any service or subtype.
+type Service struct {
+	Service int
+	Subtype int
+}
+
+func (s *Service) Set(v string) error {
+	s.Service, s.Subtype = -1, -1
+	x, y := v, ""
+	if i := strings.IndexAny(v, ":/"); i >= 0 {
+		x, y = v[:i], v[i+1:]
+	}
+	n, err := strconv.ParseUint(x, 0, 8)
+	if err != nil {
+		return fmt.Errorf("invalid service %s", x)
+	}
+	s.Service = int(n)
+	if y == "" {
+		return nil
+	}
+	if n, err = strconv.ParseUint(y, 0, 8); err != nil {
+		return fmt.Errorf("invalid subtype %s", y)
+	}
+	s.Subtype = int(n)
+	return nil
+}
+
+func (s *Service) String() string {
+	return "service"
+}
+
+func (s Service) Match(service, subtype int) bool {
+	if s.Service >= 0 && s.Service != service {
+		return false
+	}
+	return s.Subtype < 0 || s.Subtype == subtype
+}
+
+// ServiceKey gives the apid and PUS service of p (eg: 1024/3/25).
+func ServiceKey(p Packet) string {
+	t, ok := p.(*TMPacket)
+	if !ok {
+		return "-"
+	}
+	if t.PUS == nil {
+		return fmt.Sprintf("%d/-", t.CCSDS.Apid())
+	}
+	return fmt.Sprintf("%d/%s", t.CCSDS.Apid(), t.PUS)
 }
 
 type Gap struct {
@@ -94,13 +187,44 @@ type Coze struct {
 	Count   uint64 `json:"count"`
 	Missing uint64 `json:"missing"`
 	Error   uint64 `json:"error"`
+	Burst   uint64 `json:"burst"`
+
+	run uint64
+}
+
+// Add updates the counters with p, prev being the previous packet with the
+// same key.
+func (c *Coze) Add(p, prev Packet) {
+	c.Count++
+	c.Size += uint64(p.Len())
+	if g := p.Diff(prev); g != nil {
+		c.Missing += uint64(g.Missing())
+	}
+	if !p.Error() {
+		c.run = 0
+		return
+	}
+	c.Error++
+	if c.run++; c.run > c.Burst {
+		c.Burst = c.run
+	}
 }
 
+// Corrupted returns the ratio of received packets flagged as errored.
 func (c *Coze) Corrupted() float64 {
+	if c.Count == 0 {
+		return 0
+	}
+	return float64(c.Error) / float64(c.Count)
+}
+
+// Completeness returns the ratio of received packets over the expected ones
+// (received and missing).
+func (c *Coze) Completeness() float64 {
 	if c.Count == 0 && c.Missing == 0 {
 		return 0
 	}
-	return 0
+	return float64(c.Count) / float64(c.Count+c.Missing)
 }
 
 func (c *Coze) Update(o *Coze) {
@@ -108,6 +232,9 @@ func (c *Coze) Update(o *Coze) {
 	c.Count += o.Count
 	c.Error += o.Error
 	c.Missing += o.Missing
+	if o.Burst > c.Burst {
+		c.Burst = o.Burst
+	}
 }
 
 func (g *Gap) Duration() time.Duration {
@@ -12,7 +12,7 @@ import (
 const Five = time.Minute * 5
 
 var sortCommand = &cli.Command{
-	Usage: "sort [-k type] <source> <target>",
+	Usage: "sort [-k type] [-w window] <source> <target>",
 	Short: "sort packets found in a RT file",
 	Run:   runSort,
 }
@@ -63,8 +63,12 @@ func runJoin(cmd *cli.Command, args []string) error {
 }
 
 func runSort(cmd *cli.Command, args []string) error {
-	var kind Kind
+	var (
+		kind   Kind
+		window Window
+	)
 	cmd.Flag.Var(&kind, "k", "packet type")
+	cmd.Flag.Var(&window, "w", "duplicate window")
 	if err := cmd.Flag.Parse(args); err != nil {
 		return err
 	}
@@ -85,6 +89,6 @@ func runSort(cmd *cli.Command, args []string) error {
 		return err
 	}
 
-	_, err = io.CopyBuffer(NoDuplicate(target), s, make([]byte, MaxBufferSize))
+	_, err = io.CopyBuffer(window.Writer(target, kind.Decod), s, make([]byte, MaxBufferSize))
 	return err
 }
@@ -5,6 +5,7 @@ import (
 	"crypto/md5"
 	"crypto/sha1"
 	"encoding/binary"
+	"fmt"
 	"hash"
 	"io"
 	"log"
@@ -25,7 +26,7 @@ var sumCommand = &cli.Command{
 }
 
 var scanCommand = &cli.Command{
-	Usage: "scan <file...>",
+	Usage: "scan [-m mmap] <file...>",
 	Short: "fast scanning of RT file(s)",
 	Run:   runScan,
 }
@@ -50,8 +51,13 @@ func runIndex(cmd *cli.Command, args []string) error {
 		data  uint64
 		prev  time.Time
 	)
+	ctx, cancel := Interrupt()
+	defer cancel()
+
+	walker := NewWalker(ctx, cmd.Flag.Args(), kind.Decod)
+	defer walker.Close()
 	now := time.Now()
-	for p := range Walk(cmd.Flag.Args(), kind.Decod) {
+	for p := range walker.Walk() {
 		count++
 		t := p.Timestamp().Add(delta)
 		if prev.IsZero() || (t.Minute()%5 == 0 && t.Sub(prev) >= Five) {
@@ -67,7 +73,7 @@ func runIndex(cmd *cli.Command, args []string) error {
 	}
 	elapsed := time.Since(now)
 	log.Printf("%d packets (%dMB) found in %s (%.2fMB/s)", count, data>>20, elapsed, float64(data>>20)/elapsed.Seconds())
-	return nil
+	return walker.Err()
 }
 
 func runSum(cmd *cli.Command, args []string) error {
@@ -109,34 +115,77 @@ func runSum(cmd *cli.Command, args []string) error {
 }
 
 func runScan(cmd *cli.Command, args []string) error {
+	mapped := cmd.Flag.Bool("m", false, "memory mapped files")
 	if err := cmd.Flag.Parse(args); err != nil {
 		return err
 	}
 	now := time.Now()
 
-	var size, count uint64
+	var (
+		size, count uint64
+		errs        []error
+	)
 	for _, a := range cmd.Flag.Args() {
-		filepath.Walk(a, func(p string, i os.FileInfo, err error) error {
-			if err != nil || i.IsDir() {
-				return err
-			}
-			sc, err := ScanFile(p)
+		err := filepath.Walk(a, func(p string, i os.FileInfo, err error) error {
 			if err != nil {
-				return err
+				errs = append(errs, err)
+				return nil
+			}
+			if i.IsDir() {
+				return nil
 			}
-			for sc.Scan() {
-				count++
-				size += uint64(len(sc.Bytes()))
+			n, z, err := scanFile(p, *mapped)
+			count += n
+			size += z
+			if err != nil {
+				errs = append(errs, err)
 			}
-			return sc.Err()
+			return nil
 		})
+		if err != nil {
+			errs = append(errs, err)
+		}
 	}
 	elapsed := time.Since(now)
 	ratio := float64(size>>20) / elapsed.Seconds()
 	log.Printf("%d packets scanned (%dMB) time: %s (%.2f MB/s)", count, size>>20, elapsed, ratio)
+	if len(errs) > 0 {
+		for _, e := range errs {
+			log.Printf("error: %s", e)
+		}
+		return fmt.Errorf("%d files could not be scanned", len(errs))
+	}
 	return nil
 }
 
+// scanFile gives the number of packets and bytes found in file, mapped in
+// memory or not.
+func scanFile(file string, mapped bool) (uint64, uint64, error) {
+	var (
+		sc  ScanCloser
+		err error
+	)
+	if mapped {
+		sc, err = MapFile(file, nil)
+	} else {
+		sc, err = ScanFile(file)
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	defer sc.Close()
+
+	var count, size uint64
+	for sc.Scan() {
+		count++
+		size += uint64(len(sc.Bytes()))
+	}
+	if err := sc.Err(); err != nil {
+		return count, size, fmt.Errorf("%s: %s", file, err)
+	}
+	return count, size, nil
+}
+
 func sumFletcher32(r io.Reader) uint32 {
 	const mod = (1 << 16) - 1
 	rs := bufio.NewReader(r)
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+type MappedReader struct {
+	data    []byte
+	offset  int
+	decoder Decoder
+	framer  Framer
+	demux   *Demux
+
+	curr []byte
+	err  error
+
+	unmap func() error
+}
+
+func MapFile(file string, d Decoder) (*MappedReader, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	i, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !i.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s: not a regular file", file)
+	}
+	if i.Size() == 0 {
+		return NewBytesReader(nil, d), nil
+	}
+	bs, unmap, err := mapFile(f, int(i.Size()))
+	if err != nil {
+		return nil, err
+	}
+	m := NewBytesReader(bs, d)
+	m.unmap = unmap
+	return m, nil
+}
+
+func NewBytesReader(bs []byte, d Decoder) *MappedReader {
+	d = decoderOf(d)
+	return &MappedReader{
+		data:    bs,
+		decoder: d,
+		framer:  framerOf(d),
+		demux:   demuxOf(d),
+	}
+}
+
+func (m *MappedReader) Next() (Packet, error) {
+	if m.demux != nil {
+		return m.demux.next(m.read, m.decoder)
+	}
+	pos, bs, err := m.read()
+	if err != nil {
+		return nil, err
+	}
+	return decodeAt(m.decoder, bs, pos)
+}
+
+func (m *MappedReader) read() (int64, []byte, error) {
+	pos := int64(m.offset)
+	bs, err := m.next()
+	return pos, bs, err
+}
+
+func (m *MappedReader) Scan() bool {
+	m.curr, m.err = m.next()
+	return m.err == nil
+}
+
+func (m *MappedReader) Bytes() []byte {
+	return m.curr
+}
+
+func (m *MappedReader) Err() error {
+	if m.err == io.EOF {
+		return nil
+	}
+	return m.err
+}
+
+func (m *MappedReader) Close() error {
+	if m.unmap == nil {
+		return nil
+	}
+	err := m.unmap()
+	m.data, m.unmap = nil, nil
+	return err
+}
+
+func (m *MappedReader) next() ([]byte, error) {
+	offset := m.offset
+	if offset >= len(m.data) {
+		return nil, io.EOF
+	}
+	if len(m.data)-offset < m.framer.Header {
+		m.offset = len(m.data)
+		return nil, &PacketError{Offset: int64(offset), Err: ErrTruncated}
+	}
+	size := m.framer.Length(m.data[offset:])
+	if size <= m.framer.Header || size > MaxBufferSize {
+		m.offset = len(m.data)
+		return nil, &PacketError{Offset: int64(offset), Err: fmt.Errorf("%w (%d bytes)", ErrInvalidSize, size-m.framer.Header)}
+	}
+	if offset+size > len(m.data) {
+		m.offset = len(m.data)
+		return nil, &PacketError{Offset: int64(offset), Err: ErrTruncated}
+	}
+	m.offset += size
+	return m.data[offset:m.offset:m.offset], nil
+}
@@ -0,0 +1,17 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+)
+
+func mapFile(f *os.File, size int) ([]byte, func() error, error) {
+	bs, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, nil, err
+	}
+	return bs, func() error { return nil }, nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func benchmarkFile(b *testing.B) (string, int64) {
+	b.Helper()
+
+	file := filepath.Join(b.TempDir(), "rt_00_04.dat")
+	w, err := os.Create(file)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer w.Close()
+
+	var (
+		encode  = EncodeVMU(0, 0, time.Second)
+		when    = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+		payload = make([]byte, 1024)
+		size    int64
+	)
+	for i := 0; i < 1<<14; i++ {
+		bs, err := encode(int(ChannelVic1), i, when.Add(time.Duration(i)*time.Millisecond), payload)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := w.Write(bs); err != nil {
+			b.Fatal(err)
+		}
+		size += int64(len(bs))
+	}
+	return file, size
+}
+
+func BenchmarkReader(b *testing.B) {
+	file, size := benchmarkFile(b)
+	b.SetBytes(size)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r, err := os.Open(file)
+		if err != nil {
+			b.Fatal(err)
+		}
+		rs := NewReader(r, DecodeVMU())
+		for {
+			if _, err := rs.Next(); err == io.EOF {
+				break
+			} else if err != nil {
+				b.Fatal(err)
+			}
+		}
+		r.Close()
+	}
+}
+
+func BenchmarkMappedReader(b *testing.B) {
+	file, size := benchmarkFile(b)
+	b.SetBytes(size)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rs, err := MapFile(file, DecodeVMU())
+		if err != nil {
+			b.Fatal(err)
+		}
+		for {
+			if _, err := rs.Next(); err == io.EOF {
+				break
+			} else if err != nil {
+				b.Fatal(err)
+			}
+		}
+		rs.Close()
+	}
+}
+
+func BenchmarkBytesReader(b *testing.B) {
+	file, size := benchmarkFile(b)
+	b.SetBytes(size)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bs, err := ioutil.ReadFile(file)
+		if err != nil {
+			b.Fatal(err)
+		}
+		rs := NewBytesReader(bs, DecodeVMU())
+		for {
+			if _, err := rs.Next(); err == io.EOF {
+				break
+			} else if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkScan(b *testing.B) {
+	b.Run("reader", func(b *testing.B) { benchmarkScan(b, false) })
+	b.Run("mapped", func(b *testing.B) { benchmarkScan(b, true) })
+}
+
+func benchmarkScan(b *testing.B, mapped bool) {
+	file, size := benchmarkFile(b)
+	b.SetBytes(size)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, z, err := scanFile(file, mapped); err != nil {
+			b.Fatal(err)
+		} else if int64(z) != size {
+			b.Fatalf("scanned %d bytes, want %d", z, size)
+		}
+	}
+}
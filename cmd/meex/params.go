@@ -0,0 +1,349 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/midbel/cli"
+)
+
+var paramsCommand = &cli.Command{
+	Usage: "params [-k type] [-d definitions] [-p names] [-e] [-g gps-time] [-j jobs] <file...>",
+	Alias: []string{"decom"},
+	Short: "extract parameter values from TM packets",
+	Run:   runParams,
+}
+
+const (
+	TypeUint   = "uint"
+	TypeInt    = "int"
+	TypeFloat  = "float"
+	TypeBool   = "bool"
+	TypeString = "string"
+)
+
+// Parameter describes where a value is located in the packets of an apid.
+// Offset is given in bytes from the start of the CCSDS primary header and Bit
+// is the position of the first bit of the value in that byte (0 being the
+// most significant bit).
+type Parameter struct {
+	Name        string `xml:"name,attr"`
+	Apid        int    `xml:"apid,attr"`
+	Offset      int    `xml:"offset,attr"`
+	Bit         int    `xml:"bit,attr"`
+	Width       int    `xml:"width,attr"`
+	Type        string `xml:"type,attr"`
+	Endian      string `xml:"endian,attr"`
+	Calibration string `xml:"calibration,attr"`
+	Unit        string `xml:"unit,attr"`
+
+	calibrate Calibrator
+}
+
+type Value struct {
+	*Parameter
+	When time.Time
+	Raw  interface{}
+	Eng  interface{}
+}
+
+type Decommutator struct {
+	params map[int][]*Parameter
+}
+
+func LoadParameters(file string) (*Decommutator, error) {
+	r, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var ps []*Parameter
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".xml":
+		ps, err = readParametersXML(r)
+	default:
+		ps, err = readParametersCSV(r)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	return NewDecommutator(ps)
+}
+
+func NewDecommutator(ps []*Parameter) (*Decommutator, error) {
+	d := Decommutator{params: make(map[int][]*Parameter)}
+	for _, p := range ps {
+		if err := p.check(); err != nil {
+			return nil, err
+		}
+		d.params[p.Apid] = append(d.params[p.Apid], p)
+	}
+	return &d, nil
+}
+
+func readParametersXML(r io.Reader) ([]*Parameter, error) {
+	c := struct {
+		Parameters []*Parameter `xml:"parameter"`
+	}{}
+	if err := xml.NewDecoder(r).Decode(&c); err != nil {
+		return nil, err
+	}
+	return c.Parameters, nil
+}
+
+// readParametersCSV reads definitions with the columns: name, apid, offset,
+// bit, width, type, endian, calibration and unit. The last three columns
+// are optional.
+func readParametersCSV(r io.Reader) ([]*Parameter, error) {
+	rs := csv.NewReader(r)
+	rs.Comment = '#'
+	rs.FieldsPerRecord = -1
+	rs.TrimLeadingSpace = true
+
+	var ps []*Parameter
+	for {
+		row, err := rs.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(row) < 6 {
+			line, _ := rs.FieldPos(0)
+			return nil, fmt.Errorf("line %d: not enough fields", line)
+		}
+		if row[0] == "name" {
+			continue
+		}
+		for len(row) < 9 {
+			row = append(row, "")
+		}
+		p := Parameter{
+			Name:        row[0],
+			Type:        row[5],
+			Endian:      row[6],
+			Calibration: row[7],
+			Unit:        row[8],
+		}
+		for i, v := range []*int{&p.Apid, &p.Offset, &p.Bit, &p.Width} {
+			n, err := strconv.ParseInt(row[i+1], 0, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid number %s", p.Name, row[i+1])
+			}
+			*v = int(n)
+		}
+		ps = append(ps, &p)
+	}
+	return ps, nil
+}
+
+func (p *Parameter) check() error {
+	switch p.Endian = strings.ToLower(p.Endian); p.Endian {
+	case "", "big", "little":
+	default:
+		return fmt.Errorf("%s: invalid endianness %s", p.Name, p.Endian)
+	}
+	if p.Width <= 0 || p.Offset < 0 || p.Bit < 0 || p.Bit > 7 {
+		return fmt.Errorf("%s: invalid location", p.Name)
+	}
+	switch p.Type = strings.ToLower(p.Type); p.Type {
+	case TypeUint, TypeInt, TypeBool:
+		if p.Width > 64 {
+			return fmt.Errorf("%s: width too large (%d bits)", p.Name, p.Width)
+		}
+	case TypeFloat:
+		if p.Width != 32 && p.Width != 64 {
+			return fmt.Errorf("%s: float width should be 32 or 64 bits", p.Name)
+		}
+	case TypeString:
+		if p.Width%8 != 0 || p.Bit != 0 {
+			return fmt.Errorf("%s: string should be byte aligned", p.Name)
+		}
+	default:
+		return fmt.Errorf("%s: unsupported type %s", p.Name, p.Type)
+	}
+	if p.Endian == "little" && (p.Bit != 0 || p.Width%8 != 0) {
+		return fmt.Errorf("%s: little endian values should be byte aligned", p.Name)
+	}
+	c, err := ParseCalibration(p.Calibration)
+	if err != nil {
+		return fmt.Errorf("%s: %w", p.Name, err)
+	}
+	p.calibrate = c
+	return nil
+}
+
+func (p *Parameter) Extract(bs []byte) (interface{}, error) {
+	if p.Type == TypeString {
+		n := p.Width / 8
+		if p.Offset+n > len(bs) {
+			return nil, ErrShortBuffer
+		}
+		return strings.TrimRight(string(bs[p.Offset:p.Offset+n]), "\x00 "), nil
+	}
+	raw, err := extractBits(bs, p.Offset, p.Bit, p.Width, p.Endian == "little")
+	if err != nil {
+		return nil, err
+	}
+	switch p.Type {
+	case TypeInt:
+		shift := uint(64 - p.Width)
+		return int64(raw<<shift) >> shift, nil
+	case TypeFloat:
+		if p.Width == 32 {
+			return float64(math.Float32frombits(uint32(raw))), nil
+		}
+		return math.Float64frombits(raw), nil
+	case TypeBool:
+		return raw != 0, nil
+	default:
+		return raw, nil
+	}
+}
+
+func (p *Parameter) Decode(bs []byte) (interface{}, interface{}, error) {
+	raw, err := p.Extract(bs)
+	if err != nil {
+		return nil, nil, err
+	}
+	if p.calibrate == nil {
+		return raw, raw, nil
+	}
+	eng, err := p.calibrate.Calibrate(raw)
+	return raw, eng, err
+}
+
+func extractBits(bs []byte, offset, bit, width int, little bool) (uint64, error) {
+	n := (bit + width + 7) / 8
+	if offset+n > len(bs) {
+		return 0, ErrShortBuffer
+	}
+	bs = bs[offset : offset+n]
+	if little {
+		var raw uint64
+		for i := len(bs) - 1; i >= 0; i-- {
+			raw = raw<<8 | uint64(bs[i])
+		}
+		return raw, nil
+	}
+	var raw uint64
+	for i := 0; i < width; i++ {
+		pos := bit + i
+		b := (bs[pos/8] >> uint(7-pos%8)) & 0x01
+		raw = raw<<1 | uint64(b)
+	}
+	return raw, nil
+}
+
+func (d *Decommutator) Decom(t *TMPacket) []Value {
+	ps := d.params[t.CCSDS.Apid()]
+	if len(ps) == 0 {
+		return nil
+	}
+	bs := t.Payload[t.offset():]
+	vs := make([]Value, 0, len(ps))
+	for _, p := range ps {
+		raw, eng, err := p.Decode(bs)
+		if err != nil {
+			continue
+		}
+		vs = append(vs, Value{Parameter: p, When: t.Timestamp(), Raw: raw, Eng: eng})
+	}
+	return vs
+}
+
+func (d *Decommutator) Filter(patterns []string) {
+	if len(patterns) == 0 {
+		return
+	}
+	for a, ps := range d.params {
+		var vs []*Parameter
+		for _, p := range ps {
+			for _, m := range patterns {
+				if ok, _ := path.Match(m, p.Name); ok {
+					vs = append(vs, p)
+					break
+				}
+			}
+		}
+		if len(vs) == 0 {
+			delete(d.params, a)
+		} else {
+			d.params[a] = vs
+		}
+	}
+}
+
+func formatValue(v interface{}) string {
+	switch v := v.(type) {
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case string:
+		return strconv.Quote(v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func runParams(cmd *cli.Command, args []string) error {
+	var kind Kind
+	cmd.Flag.Var(&kind, "k", "packet type")
+	file := cmd.Flag.String("d", "", "parameter definitions")
+	names := cmd.Flag.String("p", "", "parameters")
+	errors := cmd.Flag.Bool("e", false, "include invalid packets")
+	toGPS := cmd.Flag.Bool("g", false, "gps time")
+	jobs := cmd.Flag.Int("j", 1, "parallel jobs")
+	if err := cmd.Flag.Parse(args); err != nil {
+		return err
+	}
+	d, err := LoadParameters(*file)
+	if err != nil {
+		return err
+	}
+	var patterns []string
+	for _, n := range strings.Split(*names, ",") {
+		if n = strings.TrimSpace(n); n != "" {
+			patterns = append(patterns, n)
+		}
+	}
+	d.Filter(patterns)
+
+	var delta time.Duration
+	if *toGPS {
+		delta = -GPS.Sub(UNIX)
+	}
+
+	ctx, cancel := Interrupt()
+	defer cancel()
+
+	const row = "%s | %4d | %-24s | %16s | %16s | %s"
+	var total uint64
+	walker := NewWalker(ctx, cmd.Flag.Args(), kind.Decod)
+	defer walker.Close()
+	walker.Jobs = *jobs
+	for p := range walker.Walk() {
+		t, ok := p.(*TMPacket)
+		if !ok || (!*errors && t.Error()) {
+			continue
+		}
+		for _, v := range d.Decom(t) {
+			total++
+			w := v.When.Add(delta).Format(TimeFormat)
+			log.Printf(row, w, v.Apid, v.Name, formatValue(v.Raw), formatValue(v.Eng), v.Unit)
+		}
+	}
+	log.Printf("%d values extracted", total)
+	return walker.Err()
+}
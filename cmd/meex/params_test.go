@@ -0,0 +1,170 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExtractBits(t *testing.T) {
+	bs := []byte{0xA5, 0x3C, 0xF0, 0x0F}
+	data := []struct {
+		Offset int
+		Bit    int
+		Width  int
+		Little bool
+		Want   uint64
+	}{
+		{Offset: 0, Bit: 0, Width: 8, Want: 0xA5},
+		{Offset: 0, Bit: 0, Width: 16, Want: 0xA53C},
+		{Offset: 0, Bit: 0, Width: 1, Want: 1},
+		{Offset: 0, Bit: 1, Width: 1, Want: 0},
+		{Offset: 0, Bit: 4, Width: 4, Want: 0x5},
+		{Offset: 0, Bit: 4, Width: 8, Want: 0x53},
+		{Offset: 1, Bit: 2, Width: 14, Want: 0x3CF0 & 0x3FFF},
+		{Offset: 1, Bit: 6, Width: 6, Want: 0x0F},
+		{Offset: 0, Bit: 0, Width: 32, Want: 0xA53CF00F},
+		{Offset: 0, Bit: 0, Width: 16, Little: true, Want: 0x3CA5},
+		{Offset: 1, Bit: 0, Width: 24, Little: true, Want: 0x0FF03C},
+		{Offset: 0, Bit: 0, Width: 32, Little: true, Want: 0x0FF03CA5},
+	}
+	for _, d := range data {
+		got, err := extractBits(bs, d.Offset, d.Bit, d.Width, d.Little)
+		if err != nil {
+			t.Errorf("%+v: unexpected error: %s", d, err)
+			continue
+		}
+		if got != d.Want {
+			t.Errorf("%+v: got %#x, want %#x", d, got, d.Want)
+		}
+	}
+	if _, err := extractBits(bs, 2, 4, 16, false); err != ErrShortBuffer {
+		t.Errorf("reading after the end of the buffer: got %v, want %s", err, ErrShortBuffer)
+	}
+}
+
+func TestParameterExtract(t *testing.T) {
+	bs := []byte{0xFE, 0x7F, 0x3F, 0x80, 0x00, 0x00, 0x01, 0x80, 'a', 'b', 0, 0}
+	data := []struct {
+		Parameter
+		Want interface{}
+	}{
+		{Parameter: Parameter{Offset: 0, Width: 8, Type: TypeInt}, Want: int64(-2)},
+		{Parameter: Parameter{Offset: 0, Width: 8, Type: TypeUint}, Want: uint64(0xFE)},
+		{Parameter: Parameter{Offset: 0, Bit: 4, Width: 4, Type: TypeInt}, Want: int64(-2)},
+		{Parameter: Parameter{Offset: 1, Width: 8, Type: TypeInt}, Want: int64(127)},
+		{Parameter: Parameter{Offset: 0, Width: 16, Type: TypeInt}, Want: int64(-385)},
+		{Parameter: Parameter{Offset: 0, Width: 16, Type: TypeInt, Endian: "little"}, Want: int64(0x7FFE)},
+		{Parameter: Parameter{Offset: 6, Width: 16, Type: TypeInt, Endian: "little"}, Want: int64(-32767)},
+		{Parameter: Parameter{Offset: 2, Width: 32, Type: TypeFloat}, Want: float64(1)},
+		{Parameter: Parameter{Offset: 6, Bit: 7, Width: 1, Type: TypeBool}, Want: true},
+		{Parameter: Parameter{Offset: 7, Bit: 7, Width: 1, Type: TypeBool}, Want: false},
+		{Parameter: Parameter{Offset: 8, Width: 32, Type: TypeString}, Want: "ab"},
+	}
+	for _, d := range data {
+		p := d.Parameter
+		if err := p.check(); err != nil {
+			t.Errorf("%+v: invalid parameter: %s", d.Parameter, err)
+			continue
+		}
+		got, err := p.Extract(bs)
+		if err != nil {
+			t.Errorf("%+v: unexpected error: %s", d.Parameter, err)
+			continue
+		}
+		if got != d.Want {
+			t.Errorf("%+v: got %v (%[2]T), want %v (%[3]T)", d.Parameter, got, d.Want)
+		}
+	}
+}
+
+func TestParameterCheck(t *testing.T) {
+	data := []Parameter{
+		{Name: "width", Width: 0, Type: TypeUint},
+		{Name: "bit", Bit: 8, Width: 8, Type: TypeUint},
+		{Name: "large", Width: 65, Type: TypeUint},
+		{Name: "float", Width: 16, Type: TypeFloat},
+		{Name: "string", Bit: 1, Width: 8, Type: TypeString},
+		{Name: "type", Width: 8, Type: "double"},
+		{Name: "endian", Width: 8, Type: TypeUint, Endian: "middle"},
+		{Name: "little", Bit: 4, Width: 4, Type: TypeUint, Endian: "little"},
+		{Name: "calibration", Width: 8, Type: TypeUint, Calibration: "linear:1"},
+	}
+	for _, p := range data {
+		if err := p.check(); err == nil {
+			t.Errorf("%s: invalid parameter accepted", p.Name)
+		}
+	}
+}
+
+func TestReadParametersCSV(t *testing.T) {
+	const defs = `name,apid,offset,bit,width,type,endian,calibration,unit
+# comment
+SEQ,100,2,2,14,uint
+B0,0x64,16,0,8,uint,,"interp:0=0;2=4",V
+W,101,16,0,16,uint,little
+`
+	ps, err := readParametersCSV(strings.NewReader(defs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Parameter{
+		{Name: "SEQ", Apid: 100, Offset: 2, Bit: 2, Width: 14, Type: TypeUint},
+		{Name: "B0", Apid: 100, Offset: 16, Width: 8, Type: TypeUint, Calibration: "interp:0=0;2=4", Unit: "V"},
+		{Name: "W", Apid: 101, Offset: 16, Width: 16, Type: TypeUint, Endian: "little"},
+	}
+	if len(ps) != len(want) {
+		t.Fatalf("got %d parameters, want %d", len(ps), len(want))
+	}
+	for i, p := range ps {
+		if *p != want[i] {
+			t.Errorf("%d: got %+v, want %+v", i, *p, want[i])
+		}
+	}
+	d, err := NewDecommutator(ps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(d.params[100]); n != 2 {
+		t.Errorf("apid 100: got %d parameters, want 2", n)
+	}
+
+	for _, s := range []string{"SEQ,100,2,2,14\n", "SEQ,100,x,2,14,uint\n"} {
+		if _, err := readParametersCSV(strings.NewReader(s)); err == nil {
+			t.Errorf("%q: invalid definition accepted", s)
+		}
+	}
+}
+
+func TestReadParametersXML(t *testing.T) {
+	const defs = `<parameters>
+	<parameter name="B0" apid="100" offset="16" bit="0" width="8" type="uint" calibration="linear:2,0" unit="V"/>
+	<parameter name="W" apid="101" offset="16" width="16" type="int" endian="little"/>
+</parameters>`
+	ps, err := readParametersXML(strings.NewReader(defs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Parameter{
+		{Name: "B0", Apid: 100, Offset: 16, Width: 8, Type: TypeUint, Calibration: "linear:2,0", Unit: "V"},
+		{Name: "W", Apid: 101, Offset: 16, Width: 16, Type: TypeInt, Endian: "little"},
+	}
+	if len(ps) != len(want) {
+		t.Fatalf("got %d parameters, want %d", len(ps), len(want))
+	}
+	for i, p := range ps {
+		if *p != want[i] {
+			t.Errorf("%d: got %+v, want %+v", i, *p, want[i])
+		}
+	}
+	if err := ps[0].check(); err != nil {
+		t.Fatal(err)
+	}
+	raw, eng, err := ps[0].Decode(make([]byte, 16, 17))
+	if err != ErrShortBuffer {
+		t.Errorf("short packet: got %v %v %v, want %s", raw, eng, err, ErrShortBuffer)
+	}
+	raw, eng, err = ps[0].Decode(append(make([]byte, 16), 21))
+	if err != nil || raw != uint64(21) || eng != float64(42) {
+		t.Errorf("got %v %v %v, want 21 42", raw, eng, err)
+	}
+}
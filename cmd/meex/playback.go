@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/midbel/cli"
+)
+
+var splitCommand = &cli.Command{
+	Usage: "split-playback [-k type] [-r realtime-dir] [-p playback-dir] [-l threshold] [-j jobs] <file...>",
+	Alias: []string{"playback"},
+	Short: "write realtime and playback packets in separate archives",
+	Run:   runSplit,
+}
+
+const (
+	ModeRealtime = "realtime"
+	ModePlayback = "playback"
+)
+
+func parseMode(v string) (string, error) {
+	switch strings.ToLower(v) {
+	case ModeRealtime, "rt":
+		return ModeRealtime, nil
+	case ModePlayback, "pb":
+		return ModePlayback, nil
+	default:
+		return "", fmt.Errorf("invalid mode %s (expected realtime or playback)", v)
+	}
+}
+
+// PacketMode classifies p as realtime or playback. VMU packets are
+// classified from their origin, other packets by comparing their latency to
+// threshold (when threshold is not zero).
+func PacketMode(p Packet, threshold time.Duration) string {
+	if v, ok := p.(*VMUPacket); ok {
+		return v.Mode()
+	}
+	if threshold > 0 && p.Reception().Sub(p.Timestamp()) > threshold {
+		return ModePlayback
+	}
+	return ModeRealtime
+}
+
+func runSplit(cmd *cli.Command, args []string) error {
+	kind := Kind{Decod: DecodeVMU()}
+	cmd.Flag.Var(&kind, "k", "packet type")
+	realtime := cmd.Flag.String("r", "", "realtime directory")
+	playback := cmd.Flag.String("p", "", "playback directory")
+	threshold := cmd.Flag.Duration("l", 0, "playback threshold")
+	jobs := cmd.Flag.Int("j", 1, "parallel jobs")
+	if err := cmd.Flag.Parse(args); err != nil {
+		return err
+	}
+	if *realtime == "" && *playback == "" {
+		return fmt.Errorf("no realtime nor playback directory provided")
+	}
+	as := make(map[string]*Archive)
+	for m, d := range map[string]string{ModeRealtime: *realtime, ModePlayback: *playback} {
+		if d == "" {
+			continue
+		}
+		if err := os.MkdirAll(d, 0755); err != nil && !os.IsExist(err) {
+			return err
+		}
+		a := NewArchive(d)
+		defer a.Close()
+		as[m] = a
+	}
+
+	ctx, cancel := Interrupt()
+	defer cancel()
+
+	cs := make(map[string]int)
+	now := time.Now()
+	walker := NewWalker(ctx, cmd.Flag.Args(), kind.Decod)
+	defer walker.Close()
+	walker.Jobs = *jobs
+	for p := range walker.Walk() {
+		m := PacketMode(p, *threshold)
+		cs[m]++
+		a, ok := as[m]
+		if !ok {
+			continue
+		}
+		if err := a.Write(p); err != nil {
+			return err
+		}
+	}
+	log.Printf("%d realtime packets, %d playback packets (%s)", cs[ModeRealtime], cs[ModePlayback], time.Since(now))
+	return walker.Err()
+}
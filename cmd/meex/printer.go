@@ -37,41 +37,22 @@ type Printer struct {
 
 func (pt *Printer) Print(p Packet, delta time.Duration) error {
 	id, _ := p.Id()
-	switch p := p.(type) {
-	default:
-	case *VMUPacket:
-		printVMUPacket(pt.line, p, p.Diff(pt.history[id]), delta)
-	case *TMPacket:
-		printTMPacket(pt.line, p, p.Diff(pt.history[id]), delta)
-	case *PDPacket:
-		printPDPacket(pt.line, p, delta)
+	if f := LookupPacket(p); f != nil && f.Print != nil {
+		f.Print(pt.line, p, p.Diff(pt.history[id]), delta)
 	}
-	pt.history[id] = p
+	// p is kept after the file it was read from is released
+	pt.history[id] = clonePacket(p)
 	return nil
 }
 
 func printVMUPacket(line *linewriter.Writer, p *VMUPacket, g *Gap, delta time.Duration) {
 	a := p.HRH.Acquisition.Add(delta)
 
-	hr, err := p.Data()
-	if err != nil {
-		return
-	}
-	var v *VMUCommonHeader
-	switch hr := hr.(type) {
-	case *Image:
-		v = hr.VMUCommonHeader
-	case *Table:
-		v = hr.VMUCommonHeader
-	default:
+	v := p.Common()
+	if v == nil {
 		return
 	}
-	var rt string
-	if v.Origin == p.VMU.Origin {
-		rt = "realtime"
-	} else {
-		rt = "playback"
-	}
+	rt := p.Mode()
 	q := v.Acquisition()
 	var diff int
 	if g != nil {
@@ -83,6 +64,7 @@ func printVMUPacket(line *linewriter.Writer, p *VMUPacket, g *Gap, delta time.Du
 	}
 	line.AppendUint(uint64(p.Len()), 9, linewriter.AlignRight)
 	line.AppendUint(uint64(p.HRH.Error), 4, linewriter.AlignRight|linewriter.WithZero|linewriter.Hex)
+	line.AppendString(p.HRH.Errors().String(), 16, linewriter.AlignLeft)
 	line.AppendTime(a, TimeFormat, linewriter.AlignRight)
 	line.AppendUint(uint64(p.Sequence()), 9, linewriter.AlignRight)
 	line.AppendUint(uint64(diff), 6, linewriter.AlignRight)
@@ -109,7 +91,7 @@ func printTMPacket(line *linewriter.Writer, p *TMPacket, g *Gap, delta time.Dura
 	if g != nil {
 		diff = g.Missing()
 	}
-	typ := p.ESA.PacketType()
+	typ := p.PacketType()
 
 	line.AppendUint(uint64(p.Sequence()), 9, linewriter.AlignRight)
 	line.AppendUint(uint64(diff), 4, linewriter.AlignRight)
@@ -118,6 +100,10 @@ func printTMPacket(line *linewriter.Writer, p *TMPacket, g *Gap, delta time.Dura
 	line.AppendTime(a, TimeFormat, linewriter.AlignRight)
 	line.AppendTime(r, TimeFormat, linewriter.AlignRight)
 	line.AppendString(typ.String(), 16, linewriter.AlignRight)
+	if p.Services {
+		line.AppendString(ServiceKey(p), 7, linewriter.AlignRight)
+		line.AppendUint(uint64(p.Source()), 8, linewriter.AlignRight|linewriter.WithZero|linewriter.Hex)
+	}
 	line.AppendUint(xxh.Sum64(p.Bytes(), 0), 8, linewriter.AlignRight|linewriter.WithZero|linewriter.Hex)
 	line.AppendDuration(p.Reception().Sub(p.Timestamp()), 8, linewriter.AlignLeft|linewriter.Millisecond)
 
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"container/heap"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+
+	"github.com/midbel/cli"
+)
+
+var reconcileCommand = &cli.Command{
+	Usage: "reconcile [-o merged] [-w window] [-g gps-time] [-j jobs] <file...>",
+	Alias: []string{"rtpb"},
+	Short: "reconcile realtime and playback copies of HRD packets",
+	Run:   runReconcile,
+}
+
+type streamKey struct {
+	Channel VMUChannel
+	Origin  uint8
+}
+
+type hrdKey struct {
+	streamKey
+	Counter uint32
+	UPI     string
+}
+
+// HRDCopy gathers the realtime and playback copies of the same HRD packet
+// (same channel, origin, counter and UPI).
+type HRDCopy struct {
+	hrdKey
+	When     time.Time
+	Realtime int
+	Playback int
+
+	best  []byte
+	valid bool
+	mode  string
+}
+
+func (c *HRDCopy) Paired() bool {
+	return c.Realtime > 0 && c.Playback > 0
+}
+
+// FilledGap is a range of counters missing from the realtime stream and the
+// number of them recovered from the playback.
+type FilledGap struct {
+	Channel VMUChannel
+	Origin  uint8
+	First   uint32
+	Last    uint32
+	Starts  time.Time
+	Ends    time.Time
+	Filled  int
+}
+
+func (g *FilledGap) Missing() int {
+	return int(g.Last-g.First) + 1
+}
+
+// DefaultReconcileWindow is the delay during which the copies of an HRD
+// packet are expected: playback usually follows realtime within hours.
+const DefaultReconcileWindow = 12 * time.Hour
+
+// Reconciler gathers the copies of the HRD packets. A packet is done once
+// the latest acquisition time seen is Window after its own: its copies are
+// then returned in acquisition order and forgotten. A copy coming later than
+// that is reported as another packet.
+type Reconciler struct {
+	Window time.Duration
+
+	copies  map[hrdKey]*HRDCopy
+	pending copyHeap
+	latest  time.Time
+
+	streams map[streamKey]*HRDCopy
+	fill    map[streamKey]int
+}
+
+func NewReconciler(window time.Duration) *Reconciler {
+	return &Reconciler{
+		Window:  window,
+		copies:  make(map[hrdKey]*HRDCopy),
+		streams: make(map[streamKey]*HRDCopy),
+		fill:    make(map[streamKey]int),
+	}
+}
+
+// Add records v as a copy of its HRD packet and returns the packets done.
+// The copy kept is the first one with a valid checksum.
+func (r *Reconciler) Add(v *VMUPacket) []*HRDCopy {
+	h := v.Common()
+	if h == nil {
+		return nil
+	}
+	k := hrdKey{
+		streamKey: streamKey{Channel: v.VMU.Channel, Origin: h.Origin},
+		Counter:   h.Counter,
+		UPI:       h.RawUPI(),
+	}
+	c, ok := r.copies[k]
+	if !ok {
+		c = &HRDCopy{hrdKey: k, When: h.Acquisition()}
+		r.copies[k] = c
+		heap.Push(&r.pending, c)
+	}
+	mode := v.Mode()
+	if mode == ModePlayback {
+		c.Playback++
+	} else {
+		c.Realtime++
+	}
+	if valid := !v.Error(); c.best == nil || (valid && !c.valid) {
+		c.best = append(c.best[:0], v.Bytes()...)
+		c.valid, c.mode = valid, mode
+	}
+	if c.When.After(r.latest) {
+		r.latest = c.When
+	}
+	return r.done(r.latest.Add(-r.Window))
+}
+
+// Flush returns the packets not yet done.
+func (r *Reconciler) Flush() []*HRDCopy {
+	return r.done(time.Time{})
+}
+
+func (r *Reconciler) done(until time.Time) []*HRDCopy {
+	var cs []*HRDCopy
+	for r.pending.Len() > 0 {
+		c := r.pending[0]
+		if !until.IsZero() && !c.When.Before(until) {
+			break
+		}
+		heap.Pop(&r.pending)
+		delete(r.copies, c.hrdKey)
+		cs = append(cs, c)
+	}
+	return cs
+}
+
+// Gap updates the realtime stream of c with it and returns the gap ended by
+// c with the number of packets found in the playback. The packets of a
+// stream should be given in order.
+func (r *Reconciler) Gap(c *HRDCopy) *FilledGap {
+	k := c.streamKey
+	if c.Realtime == 0 {
+		if _, ok := r.streams[k]; ok {
+			r.fill[k]++
+		}
+		return nil
+	}
+	var g *FilledGap
+	if p, ok := r.streams[k]; ok && c.Counter > p.Counter+1 {
+		g = &FilledGap{
+			Channel: c.Channel,
+			Origin:  c.Origin,
+			First:   p.Counter + 1,
+			Last:    c.Counter - 1,
+			Starts:  p.When,
+			Ends:    c.When,
+			Filled:  r.fill[k],
+		}
+	}
+	r.streams[k], r.fill[k] = c, 0
+	return g
+}
+
+type copyHeap []*HRDCopy
+
+func (h copyHeap) Len() int { return len(h) }
+
+func (h copyHeap) Less(i, j int) bool {
+	if !h[i].When.Equal(h[j].When) {
+		return h[i].When.Before(h[j].When)
+	}
+	if h[i].Channel != h[j].Channel {
+		return h[i].Channel < h[j].Channel
+	}
+	return h[i].Counter < h[j].Counter
+}
+
+func (h copyHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *copyHeap) Push(x interface{}) {
+	*h = append(*h, x.(*HRDCopy))
+}
+
+func (h *copyHeap) Pop() interface{} {
+	old := *h
+	c := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return c
+}
+
+func runReconcile(cmd *cli.Command, args []string) error {
+	file := cmd.Flag.String("o", "", "merged file")
+	window := cmd.Flag.Duration("w", DefaultReconcileWindow, "delay between realtime and playback")
+	toGPS := cmd.Flag.Bool("g", false, "gps time")
+	jobs := cmd.Flag.Int("j", 1, "parallel jobs")
+	if err := cmd.Flag.Parse(args); err != nil {
+		return err
+	}
+	var delta time.Duration
+	if *toGPS {
+		delta = -GPS.Sub(UNIX)
+	}
+	var w io.Writer = ioutil.Discard
+	if *file != "" {
+		f, err := os.Create(*file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	ctx, cancel := Interrupt()
+	defer cancel()
+
+	const row = "%5s | %02x | %s | %s | %10d | %10d | %8d | %8d | %8d"
+	var (
+		now = time.Now()
+		r   = NewReconciler(*window)
+
+		missing, filled int
+		total, rt, pb   int
+		pairs           int
+	)
+	process := func(cs []*HRDCopy) error {
+		for _, c := range cs {
+			total++
+			if c.Realtime > 0 {
+				rt++
+			}
+			if c.Playback > 0 {
+				pb++
+			}
+			if c.Paired() {
+				pairs++
+			}
+			if g := r.Gap(c); g != nil {
+				missing += g.Missing()
+				filled += g.Filled
+				s, e := g.Starts.Add(delta).Format(TimeFormat), g.Ends.Add(delta).Format(TimeFormat)
+				log.Printf(row, g.Channel, g.Origin, s, e, g.First, g.Last, g.Missing(), g.Filled, g.Missing()-g.Filled)
+			}
+			if _, err := w.Write(c.best); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	walker := NewWalker(ctx, cmd.Flag.Args(), DecodeVMU())
+	defer walker.Close()
+	walker.Jobs = *jobs
+	for p := range walker.Walk() {
+		v, ok := p.(*VMUPacket)
+		if !ok {
+			continue
+		}
+		if err := process(r.Add(v)); err != nil {
+			return err
+		}
+	}
+	if err := walker.Err(); err != nil {
+		return err
+	}
+	if err := process(r.Flush()); err != nil {
+		return err
+	}
+	log.Printf("%d HRD packets (%d realtime, %d playback, %d pairs)", total, rt, pb, pairs)
+	log.Printf("%d missing in realtime, %d filled by playback (%s)", missing, filled, time.Since(now))
+	return nil
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/midbel/linewriter"
+)
+
+type PrintFunc func(*linewriter.Writer, Packet, *Gap, time.Duration)
+
+type Family struct {
+	Name  string
+	Alias []string
+
+	Decoder   func() Decoder
+	Configure func(string) (Decoder, error)
+	Encoder   func(*Generator) EncoderFunc
+	Store     func([]byte) ([]byte, error)
+	Sort      SortFunc
+
+	Match     func(Packet) bool
+	Key       func(Packet) string
+	Duplicate func(Packet) []byte
+	Format    func(*Info) string
+	Print     PrintFunc
+	Detect    func([]byte) bool
+
+	Header  int
+	Payload int
+}
+
+var families []*Family
+
+func Register(f *Family) {
+	if f == nil || f.Name == "" || f.Decoder == nil {
+		panic("meex: invalid packet family")
+	}
+	for _, n := range append([]string{f.Name}, f.Alias...) {
+		if _, err := Lookup(n); err == nil {
+			panic(fmt.Sprintf("meex: packet family %s already registered", n))
+		}
+	}
+	families = append(families, f)
+}
+
+func Lookup(name string) (*Family, error) {
+	name = strings.ToLower(name)
+	for _, f := range families {
+		if f.Name == name {
+			return f, nil
+		}
+		for _, a := range f.Alias {
+			if a == name {
+				return f, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("unrecognized packet type %s", name)
+}
+
+// DecoderWith returns the decoder of the family configured with opts.
+func (f *Family) DecoderWith(opts string) (Decoder, error) {
+	if opts == "" {
+		return f.Decoder(), nil
+	}
+	if f.Configure == nil {
+		return nil, fmt.Errorf("packet type %s has no options", f.Name)
+	}
+	return f.Configure(opts)
+}
+
+func LookupPacket(p Packet) *Family {
+	for _, f := range families {
+		if f.Match != nil && f.Match(p) {
+			return f
+		}
+	}
+	return nil
+}
+
+// parseTMOptions parses the comma separated options of the CCSDS families:
+// pec and pus, optionally followed by the list of APIDs carrying a PUS header
+// (eg: pec,pus=1024/1025).
+func parseTMOptions(opts string) (TMOptions, error) {
+	var o TMOptions
+	for _, v := range strings.Split(opts, ",") {
+		v, as := v, ""
+		if i := strings.Index(v, "="); i >= 0 {
+			v, as = v[:i], v[i+1:]
+		}
+		switch v {
+		case "pec", "crc":
+			o.PEC = true
+		case "pus":
+			o.PUS = true
+			for _, a := range strings.Split(as, "/") {
+				if a == "" {
+					continue
+				}
+				n, err := strconv.ParseUint(a, 0, 11)
+				if err != nil {
+					return o, fmt.Errorf("invalid apid %s", a)
+				}
+				o.Apids = append(o.Apids, int(n))
+			}
+			sort.Ints(o.Apids)
+		default:
+			return o, fmt.Errorf("invalid option %s (expected pec or pus)", v)
+		}
+	}
+	return o, nil
+}
+
+func init() {
+	Register(&Family{
+		Name:    "vmu",
+		Alias:   []string{"hrdl"},
+		Decoder: DecodeVMU,
+		Configure: func(opts string) (Decoder, error) {
+			mode, err := parseMode(opts)
+			return DecodeVMUMode(mode), err
+		},
+		Encoder: func(g *Generator) EncoderFunc { return EncodeVMU(g.Origin, g.Playback, g.Latency) },
+		Store:   storeVMU,
+		Sort:    SortHRDIndex,
+		Match: func(p Packet) bool {
+			_, ok := p.(*VMUPacket)
+			return ok
+		},
+		Key: func(p Packet) string {
+			return p.(*VMUPacket).VMU.Channel.String()
+		},
+		Duplicate: duplicateVMU,
+		Format: func(i *Info) string {
+			return VMUChannel(i.Id).String()
+		},
+		Print: func(line *linewriter.Writer, p Packet, g *Gap, delta time.Duration) {
+			printVMUPacket(line, p.(*VMUPacket), g, delta)
+		},
+		Detect:  isVMU,
+		Header:  HRDLHeaderLen,
+		Payload: HRDLHeaderLen + VMUHeaderLen,
+	})
+	Register(&Family{
+		Name:    "tm",
+		Alias:   []string{"pth", "pt"},
+		Decoder: DecodeTM,
+		Configure: func(opts string) (Decoder, error) {
+			o, err := parseTMOptions(opts)
+			return DecodeTMWith(o), err
+		},
+		Encoder: func(g *Generator) EncoderFunc { return EncodeTM(g.Latency) },
+		Store:   storePTH,
+		Sort:    SortTMIndex,
+		Match: func(p Packet) bool {
+			t, ok := p.(*TMPacket)
+			return ok && t.PTH != nil
+		},
+		Key: func(p Packet) string {
+			return fmt.Sprint(p.(*TMPacket).CCSDS.Apid())
+		},
+		Duplicate: duplicateTM,
+		Format: func(i *Info) string {
+			return fmt.Sprint(i.Id)
+		},
+		Print: func(line *linewriter.Writer, p Packet, g *Gap, delta time.Duration) {
+			printTMPacket(line, p.(*TMPacket), g, delta)
+		},
+		Detect:  isTM,
+		Header:  PTHHeaderLen,
+		Payload: PTHHeaderLen + CCSDSHeaderLen + ESAHeaderLen,
+	})
+	Register(&Family{
+		Name:    "ccsds",
+		Alias:   []string{"raw"},
+		Decoder: func() Decoder { return DecodeCCSDS(true, TMOptions{}) },
+		Configure: func(opts string) (Decoder, error) {
+			o, err := parseTMOptions(opts)
+			return DecodeCCSDS(true, o), err
+		},
+		Store: storeRaw,
+		Sort:  SortTMIndex,
+		Match: func(p Packet) bool {
+			t, ok := p.(*TMPacket)
+			return ok && t.PTH == nil && t.ESA != nil
+		},
+		Key: func(p Packet) string {
+			return fmt.Sprint(p.(*TMPacket).CCSDS.Apid())
+		},
+		Duplicate: duplicateTM,
+		Print: func(line *linewriter.Writer, p Packet, g *Gap, delta time.Duration) {
+			printTMPacket(line, p.(*TMPacket), g, delta)
+		},
+		Payload: CCSDSHeaderLen + ESAHeaderLen,
+	})
+	Register(&Family{
+		Name:    "ccsds-bare",
+		Alias:   []string{"bare"},
+		Decoder: func() Decoder { return DecodeCCSDS(false, TMOptions{}) },
+		Configure: func(opts string) (Decoder, error) {
+			o, err := parseTMOptions(opts)
+			return DecodeCCSDS(false, o), err
+		},
+		Store: storeRaw,
+		Sort:  SortTMIndex,
+		Match: func(p Packet) bool {
+			t, ok := p.(*TMPacket)
+			return ok && t.PTH == nil && t.ESA == nil
+		},
+		Key: func(p Packet) string {
+			return fmt.Sprint(p.(*TMPacket).CCSDS.Apid())
+		},
+		Duplicate: duplicateTM,
+		Print: func(line *linewriter.Writer, p Packet, g *Gap, delta time.Duration) {
+			printTMPacket(line, p.(*TMPacket), g, delta)
+		},
+		Payload: CCSDSHeaderLen,
+	})
+	Register(&Family{
+		Name:  "aos",
+		Alias: []string{"vcdu"},
+		Decoder: func() Decoder {
+			d, _ := DecodeFrames(FrameAOS, "")
+			return d
+		},
+		Configure: func(opts string) (Decoder, error) {
+			return DecodeFrames(FrameAOS, opts)
+		},
+	})
+	Register(&Family{
+		Name:  "tmf",
+		Alias: []string{"tmframe"},
+		Decoder: func() Decoder {
+			d, _ := DecodeFrames(FrameTM, "")
+			return d
+		},
+		Configure: func(opts string) (Decoder, error) {
+			return DecodeFrames(FrameTM, opts)
+		},
+	})
+	Register(&Family{
+		Name:    "tc",
+		Alias:   []string{"cmd", "uplink"},
+		Decoder: DecodeTC,
+		Configure: func(opts string) (Decoder, error) {
+			o, err := parseTMOptions(opts)
+			return DecodeTCWith(o), err
+		},
+		Encoder: func(_ *Generator) EncoderFunc { return EncodeTC() },
+		Store:   storeTC,
+		Sort:    SortTMIndex,
+		Match: func(p Packet) bool {
+			_, ok := p.(*TCPacket)
+			return ok
+		},
+		Key: func(p Packet) string {
+			return fmt.Sprint(p.(*TCPacket).CCSDS.Apid())
+		},
+		Duplicate: duplicateTC,
+		Format: func(i *Info) string {
+			return fmt.Sprint(i.Id)
+		},
+		Print: func(line *linewriter.Writer, p Packet, g *Gap, delta time.Duration) {
+			printTCPacket(line, p.(*TCPacket), g, delta)
+		},
+		Detect:  isTC,
+		Header:  TCHeaderLen,
+		Payload: TCHeaderLen + CCSDSHeaderLen + ESAHeaderLen,
+	})
+	Register(&Family{
+		Name:    "pd",
+		Alias:   []string{"pp", "pdh"},
+		Decoder: DecodePD,
+		Encoder: func(_ *Generator) EncoderFunc { return EncodePD() },
+		Store:   storePDH,
+		Match: func(p Packet) bool {
+			_, ok := p.(*PDPacket)
+			return ok
+		},
+		Key: func(p Packet) string {
+			return fmt.Sprintf("0x%x", p.(*PDPacket).UMI.Code[:])
+		},
+		Duplicate: duplicatePD,
+		Format: func(i *Info) string {
+			return fmt.Sprintf("%x", i.Id)
+		},
+		Print: func(line *linewriter.Writer, p Packet, _ *Gap, delta time.Duration) {
+			printPDPacket(line, p.(*PDPacket), delta)
+		},
+		Detect:  isPD,
+		Header:  UMIHeaderLen,
+		Payload: UMIHeaderLen,
+	})
+	Register(&Family{
+		Name:    "hrd",
+		Decoder: DecodeHRD,
+		Configure: func(opts string) (Decoder, error) {
+			mode, err := parseMode(opts)
+			return DecodeHRDMode(mode), err
+		},
+		Match: func(p Packet) bool {
+			_, ok := p.(HRPacket)
+			return ok
+		},
+		Key: func(p Packet) string {
+			h := p.(HRPacket)
+			i, _ := h.Id()
+			return fmt.Sprintf("%x/%s/%s", i, h.Type(), h.String())
+		},
+		Format: func(i *Info) string {
+			return fmt.Sprintf("%s-%x", i.Context, i.Id)
+		},
+	})
+}
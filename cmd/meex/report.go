@@ -2,6 +2,7 @@ package main
 
 import (
 	"log"
+	"sort"
 	"time"
 
 	"github.com/midbel/cli"
@@ -11,27 +12,27 @@ import (
 const TimeFormat = "2006-01-02 15:04:05.000"
 
 var countCommand = &cli.Command{
-	Usage: "count [-k type] [-g gps-time] <file...>",
+	Usage: "count [-k type] [-g gps-time] [-j jobs] [-s service] [-b bucket] [-l lateness] [-z] [-f state] <file...>",
 	Short: "count packets available into RT file(s)",
 	Run:   runCount,
 }
 
 var listCommand = &cli.Command{
-	Usage: "list [-e with-invalid] [-f format] [-k type] [-g gps-time] [-i pid] <file...>",
+	Usage: "list [-e with-invalid] [-f format] [-k type] [-g gps-time] [-i pid] [-s service] [-j jobs] <file...>",
 	Alias: []string{"ls"},
 	Short: "list packets present into RT file(s)",
 	Run:   runList,
 }
 
 var diffCommand = &cli.Command{
-	Usage: "diff [-g gps-time] [-k type] [-d duration] <file...>",
+	Usage: "diff [-g gps-time] [-k type] [-d duration] [-f state] [-j jobs] <file...>",
 	Alias: []string{"show-gaps"},
 	Short: "report missing packets in RT file(s)",
 	Run:   runDiff,
 }
 
 var errCommand = &cli.Command{
-	Usage: "verify [-k type] <file...>",
+	Usage: "verify [-k type] [-c checksum] [-g gps-time] [-b bucket] [-l lateness] [-j jobs] <file...>",
 	Alias: []string{"check"},
 	Short: "report error in packets found in RT file(s)",
 	Run:   runError,
@@ -45,6 +46,9 @@ func runList(cmd *cli.Command, args []string) error {
 	id := cmd.Flag.Int("i", 0, "")
 	toGPS := cmd.Flag.Bool("g", false, "gps time")
 	erronly := cmd.Flag.Bool("e", false, "include invalid packets")
+	jobs := cmd.Flag.Int("j", 1, "parallel jobs")
+	service := Service{Service: -1, Subtype: -1}
+	cmd.Flag.Var(&service, "s", "PUS service[:subtype] (with -k tm:pus)")
 	if err := cmd.Flag.Parse(args); err != nil {
 		return err
 	}
@@ -61,7 +65,13 @@ func runList(cmd *cli.Command, args []string) error {
 	if *toGPS {
 		delta = -GPS.Sub(UNIX)
 	}
-	queue := Walk(cmd.Flag.Args(), DecodeById(*id, kind.Decod))
+	ctx, cancel := Interrupt()
+	defer cancel()
+
+	walker := NewWalker(ctx, cmd.Flag.Args(), DecodeByService(service, DecodeById(*id, kind.Decoder())))
+	defer walker.Close()
+	walker.Jobs = *jobs
+	queue := walker.Walk()
 	var size, total uint64
 	n := time.Now()
 	for p := range queue {
@@ -75,7 +85,7 @@ func runList(cmd *cli.Command, args []string) error {
 		}
 	}
 	log.Printf("%d packets found %s (%dMB)", total, time.Since(n), size>>20)
-	return nil
+	return walker.Err()
 }
 
 func runDiff(cmd *cli.Command, args []string) error {
@@ -84,9 +94,15 @@ func runDiff(cmd *cli.Command, args []string) error {
 	mem := cmd.Flag.Bool("memprofile", false, "profile memory usage")
 	toGPS := cmd.Flag.Bool("g", false, "gps time")
 	duration := cmd.Flag.Duration("d", 0, "duration")
+	jobs := cmd.Flag.Int("j", 1, "parallel jobs")
+	file := cmd.Flag.String("f", "", "state file")
 	if err := cmd.Flag.Parse(args); err != nil {
 		return err
 	}
+	state, err := loadState(*file)
+	if err != nil {
+		return err
+	}
 
 	if *mem {
 		defer profile.Start(profile.MemProfile).Stop()
@@ -105,7 +121,14 @@ func runDiff(cmd *cli.Command, args []string) error {
 		elapsed time.Duration
 	)
 
-	for g := range Gaps(cmd.Flag.Args(), kind.Decod) {
+	ctx, cancel := Interrupt()
+	defer cancel()
+
+	walker := NewWalker(ctx, cmd.Flag.Args(), kind.Decod)
+	defer walker.Close()
+	walker.Jobs = *jobs
+	walker.State = state
+	for g := range walker.Gaps() {
 		count++
 		missing += uint64(g.Missing())
 		elapsed += g.Duration()
@@ -118,53 +141,175 @@ func runDiff(cmd *cli.Command, args []string) error {
 		}
 	}
 	log.Printf("%d gaps found (%d missing packets - %s)", count, missing, elapsed)
-	return nil
+	return saveState(walker, *file)
+}
+
+func loadState(file string) (*State, error) {
+	if file == "" {
+		return nil, nil
+	}
+	return LoadState(file)
+}
+
+// saveState saves the state of the walker only if all its files have been
+// processed without error.
+func saveState(w *Walker, file string) error {
+	if err := w.Err(); err != nil || file == "" || w.State == nil {
+		return err
+	}
+	return w.State.Save(file)
 }
 
 func runError(cmd *cli.Command, args []string) error {
 	var kind Kind
 	cmd.Flag.Var(&kind, "k", "packet type")
+	jobs := cmd.Flag.Int("j", 1, "parallel jobs")
+	checksum := cmd.Flag.Bool("c", false, "report VMU checksum mismatches")
+	toGPS := cmd.Flag.Bool("g", false, "gps time")
+	var bucket Bucket
+	cmd.Flag.Var(&bucket, "b", "bucket")
+	lateness := cmd.Flag.Duration("l", DefaultLateness, "delay before closing a bucket")
 	if err := cmd.Flag.Parse(args); err != nil {
 		return err
 	}
 
+	var delta time.Duration
+	if *toGPS {
+		delta = -GPS.Sub(UNIX)
+	}
+	const row = "%5s | %02x | %s | %s | %12s | %8d | %s"
+	printRun := func(r *ErrorRun) {
+		if r == nil {
+			return
+		}
+		s, e := r.Starts.Add(delta).Format(TimeFormat), r.Ends.Add(delta).Format(TimeFormat)
+		log.Printf(row, r.Channel, r.Origin, s, e, r.Duration(), r.Count, r)
+	}
+
 	var err, total uint64
 	cs := make(map[uint64]uint64)
+	tracker := NewErrorTracker(*checksum)
+	var keys []*KeyTimeCoze
+	counter := NewCounter(bucket)
+	counter.Lateness = *lateness
+	ts := make(map[int]map[string]uint64)
+	segments := make(map[int]int)
 
+	ctx, cancel := Interrupt()
+	defer cancel()
+
+	walker := NewWalker(ctx, cmd.Flag.Args(), kind.Decod)
+	defer walker.Close()
+	walker.Jobs = *jobs
 	n := time.Now()
-	for p := range Walk(cmd.Flag.Args(), kind.Decod) {
+	walker.apply(func(p Packet) error {
 		total++
+		keys = append(keys, counter.Add(p)...)
+		if t, ok := p.(*TMPacket); ok {
+			e := t.Check()
+			apid, seg := t.CCSDS.Apid(), t.CCSDS.Segmentation()
+			if prev, ok := segments[apid]; ok && !validSegment(prev, seg) {
+				e |= ErrCCSDSSegment
+			}
+			segments[apid] = seg
+			if e == 0 {
+				return nil
+			}
+			err++
+			if ts[apid] == nil {
+				ts[apid] = make(map[string]uint64)
+			}
+			for _, c := range e.Categories() {
+				ts[apid][c]++
+			}
+			return nil
+		}
+		if v, ok := p.(*VMUPacket); ok {
+			printRun(tracker.Update(v))
+		}
 		if !p.Error() {
-			continue
+			return nil
 		}
 		err++
 
 		switch p := p.(type) {
 		default:
-		case *VMUPacket:
-			cs[uint64(p.HRH.Error)]++
 		case *PDPacket:
 			cs[uint64(p.UMI.Orbit)]++
 		}
-	}
+		return nil
+	}, counter.detach)
 	elapsed := time.Since(n)
+	for _, r := range tracker.Flush() {
+		printRun(r)
+	}
+	for _, c := range tracker.Counts() {
+		log.Printf("%5s | %02x | %-12s | %8d", c.Channel, c.Origin, c.Flag, c.Count)
+	}
 	for e, c := range cs {
 		log.Printf("%04x: %8d", e, c)
 	}
+	for _, k := range append(keys, counter.Flush()...) {
+		printCoze(k, delta, bucket)
+	}
+	apids := make([]int, 0, len(ts))
+	for a := range ts {
+		apids = append(apids, a)
+	}
+	sort.Ints(apids)
+	for _, a := range apids {
+		for _, c := range ccsdsErrors {
+			if n := ts[a][c.Name]; n > 0 {
+				log.Printf("%4d | %-9s | %8d", a, c.Name, n)
+			}
+		}
+	}
 	log.Printf("%d errors found (%d packets, %s)", err, total, elapsed)
-	return nil
+	return walker.Err()
+}
+
+// validSegment reports whether a packet with the segmentation flags curr can
+// follow a packet with the flags prev on the same apid.
+func validSegment(prev, curr int) bool {
+	open := prev == SegmentFirst || prev == SegmentContinuation
+	switch curr {
+	case SegmentFirst, SegmentUnsegmented:
+		return !open
+	default:
+		return open
+	}
+}
+
+const cozeRow = "%23s | %20s | %8d | %8d | %8dMB | %8d | %6.2f%% | %6.2f%% | %6d"
+
+func printCoze(c *KeyTimeCoze, delta time.Duration, b Bucket) {
+	when := "-"
+	if !c.When.IsZero() {
+		when = b.Format(c.When.Add(delta))
+	}
+	log.Printf(cozeRow, when, c.Key, c.Count, c.Missing, c.Size>>20, c.Error, c.Corrupted()*100, c.Completeness()*100, c.Burst)
 }
 
 func runCount(cmd *cli.Command, args []string) error {
-	const row = "%20s | %20s | %8d | %8d | %8dMB | %8d"
 
 	var kind Kind
 	cmd.Flag.Var(&kind, "k", "packet type")
 	mem := cmd.Flag.Bool("memprofile", false, "profile memory usage")
 	toGPS := cmd.Flag.Bool("g", false, "to gps time")
+	jobs := cmd.Flag.Int("j", 1, "parallel jobs")
+	services := cmd.Flag.Bool("s", false, "count by apid and PUS service (with -k tm:pus)")
+	bucket := Bucket{Width: Day}
+	cmd.Flag.Var(&bucket, "b", "bucket")
+	empty := cmd.Flag.Bool("z", false, "report empty buckets")
+	lateness := cmd.Flag.Duration("l", DefaultLateness, "delay before closing a bucket")
+	file := cmd.Flag.String("f", "", "state file (open buckets are reported by the next run)")
 	if err := cmd.Flag.Parse(args); err != nil {
 		return err
 	}
+	state, err := loadState(*file)
+	if err != nil {
+		return err
+	}
 
 	if *mem {
 		defer profile.Start(profile.MemProfile).Stop()
@@ -177,10 +322,22 @@ func runCount(cmd *cli.Command, args []string) error {
 
 	var z Coze
 	now := time.Now()
-	for c := range CountByDay(cmd.Flag.Args(), kind.Decod) {
+	ctx, cancel := Interrupt()
+	defer cancel()
+
+	walker := NewWalker(ctx, cmd.Flag.Args(), kind.Decod)
+	defer walker.Close()
+	walker.Jobs = *jobs
+	walker.State = state
+	if *services {
+		walker.Key = ServiceKey
+	}
+	counter := NewCounter(bucket)
+	counter.Empty, counter.Lateness = *empty, *lateness
+	for c := range walker.Count(counter) {
 		z.Update(c.Coze)
-		log.Printf(row, c.When.Add(delta).Format("2006-01-02"), c.Key, c.Count, c.Missing, c.Size>>20, c.Error)
+		printCoze(c, delta, bucket)
 	}
-	log.Printf("%d packets found, %d missing (%dMB, %s)", z.Count, z.Missing, z.Size>>20, time.Since(now))
-	return nil
+	log.Printf("%d packets found, %d missing, %d errors (%.2f%% complete, %dMB, %s)", z.Count, z.Missing, z.Error, z.Completeness()*100, z.Size>>20, time.Since(now))
+	return saveState(walker, *file)
 }
@@ -1,13 +1,13 @@
 package main
 
 import (
-	"crypto/md5"
 	"fmt"
 	"io"
 	"math/rand"
 	"os"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"sync"
 	"time"
 
@@ -62,7 +62,14 @@ func JoinWith(d Decoder, f SortFunc, rs ...io.ReadSeeker) (io.Reader, error) {
 }
 
 func indexReader(r io.ReadSeeker, d Decoder) ([]*Index, string, error) {
-	ix, sum := NewReader(r, d).IndexSum()
+	if demuxOf(d) != nil {
+		return nil, "", ErrFramed
+	}
+	rt := NewReader(r, d)
+	ix, sum := rt.IndexSum()
+	if err := rt.Err(); err != nil {
+		return nil, sum, err
+	}
 	index := make([]*Index, len(ix))
 	for j, i := range ix {
 		i.Sum = sum
@@ -103,7 +110,14 @@ func Sort(r io.ReadSeeker, d Decoder) (io.Reader, error) {
 }
 
 func SortWith(r io.ReadSeeker, d Decoder, f SortFunc) (io.Reader, error) {
-	ix := NewReader(r, d).Index()
+	if demuxOf(d) != nil {
+		return nil, ErrFramed
+	}
+	rt := NewReader(r, d)
+	ix := rt.Index()
+	if err := rt.Err(); err != nil {
+		return nil, err
+	}
 	if _, err := r.Seek(0, io.SeekStart); err != nil {
 		return nil, err
 	}
@@ -117,12 +131,58 @@ func SortWith(r io.ReadSeeker, d Decoder, f SortFunc) (io.Reader, error) {
 	return &shuffler{index: ix, reader: r}, nil
 }
 
+func NewRand(seed int64) *rand.Rand {
+	return rand.New(rand.NewSource(seed))
+}
+
+func TimeRand() *rand.Rand {
+	return NewRand(time.Now().UnixNano())
+}
+
+// Seed is the seed given to a random generator. When it is not set, the seed
+// is derived from the current time.
+type Seed struct {
+	value int64
+	set   bool
+}
+
+func (s *Seed) Set(v string) error {
+	n, err := strconv.ParseInt(v, 0, 64)
+	if err != nil {
+		return fmt.Errorf("invalid seed %s", v)
+	}
+	s.value, s.set = n, true
+	return nil
+}
+
+func (s *Seed) String() string {
+	return "random seed"
+}
+
+func (s *Seed) Rand() *rand.Rand {
+	if !s.set {
+		return TimeRand()
+	}
+	return NewRand(s.value)
+}
+
 func Shuffle(rs io.ReadSeeker, d Decoder) (io.Reader, error) {
-	ix := NewReader(rs, d).Index()
+	return ShuffleWith(rs, d, TimeRand())
+}
+
+func ShuffleWith(rs io.ReadSeeker, d Decoder, rg *rand.Rand) (io.Reader, error) {
+	if demuxOf(d) != nil {
+		return nil, ErrFramed
+	}
+	rt := NewReader(rs, d)
+	ix := rt.Index()
+	if err := rt.Err(); err != nil {
+		return nil, err
+	}
 	if _, err := rs.Seek(0, io.SeekStart); err != nil {
 		return nil, err
 	}
-	rand.Shuffle(len(ix), func(i, j int) { ix[i], ix[j] = ix[j], ix[i] })
+	rg.Shuffle(len(ix), func(i, j int) { ix[i], ix[j] = ix[j], ix[i] })
 	return &shuffler{index: ix, reader: rs}, nil
 }
 
@@ -142,18 +202,90 @@ func (s *shuffler) Read(bs []byte) (int, error) {
 	return io.ReadFull(s.reader, bs[:ix.Size])
 }
 
+type SplitFunc func([]byte) int
+
+func SplitRandom(n int, rg *rand.Rand) SplitFunc {
+	return func(_ []byte) int {
+		return rg.Intn(n)
+	}
+}
+
+func SplitRoundRobin(n int) SplitFunc {
+	var curr int
+	return func(_ []byte) int {
+		ix := curr
+		curr = (curr + 1) % n
+		return ix
+	}
+}
+
+func SplitSize(n int) SplitFunc {
+	sizes := make([]int, n)
+	return func(bs []byte) int {
+		var ix int
+		for i := range sizes {
+			if sizes[i] < sizes[ix] {
+				ix = i
+			}
+		}
+		sizes[ix] += len(bs)
+		return ix
+	}
+}
+
+func SplitTime(n int, d Decoder, interval time.Duration) SplitFunc {
+	if interval <= 0 {
+		interval = Five
+	}
+	return func(bs []byte) int {
+		p, err := d.Decode(bs)
+		if err != nil || p == nil {
+			return 0
+		}
+		// the packets before 1970 (eg: without time) give a negative index
+		t := p.Timestamp().Sub(UNIX) / interval
+		return splitIndex(int(t%time.Duration(n)), n)
+	}
+}
+
+func SplitId(n int, d Decoder) SplitFunc {
+	return func(bs []byte) int {
+		p, err := d.Decode(bs)
+		if err != nil || p == nil {
+			return 0
+		}
+		id, _ := p.Id()
+		return splitIndex(id, n)
+	}
+}
+
 type splitWriters struct {
 	writers []io.WriteCloser
+	split   SplitFunc
 }
 
 func SplitWriter(file string, n int) (io.WriteCloser, error) {
+	return SplitWriterWith(file, n, SplitRandom(n, TimeRand()))
+}
+
+func checkParts(n int) error {
 	if n < 2 {
-		return nil, fmt.Errorf("")
+		return fmt.Errorf("at least two parts expected (got %d)", n)
+	}
+	return nil
+}
+
+func splitIndex(i, n int) int {
+	return ((i % n) + n) % n
+}
+
+func SplitWriterWith(file string, n int, f SplitFunc) (io.WriteCloser, error) {
+	if err := checkParts(n); err != nil {
+		return nil, err
 	}
 	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil && !os.IsExist(err) {
 		return nil, err
 	}
-	rand.Seed(time.Now().Unix())
 
 	ws := make([]io.WriteCloser, n)
 	for i := 0; i < n; i++ {
@@ -167,11 +299,11 @@ func SplitWriter(file string, n int) (io.WriteCloser, error) {
 		}
 		ws[i] = w
 	}
-	return &splitWriters{writers: ws}, nil
+	return &splitWriters{writers: ws, split: f}, nil
 }
 
 func (sw *splitWriters) Write(bs []byte) (int, error) {
-	ix := rand.Intn(len(sw.writers))
+	ix := splitIndex(sw.split(bs), len(sw.writers))
 	return sw.writers[ix].Write(bs)
 }
 
@@ -186,46 +318,56 @@ func (sw *splitWriters) Close() error {
 }
 
 type mixReaders struct {
-	rs []Scanner
+	rand    *rand.Rand
+	rs      []Scanner
+	weights []int
 }
 
 func MixReader(rs ...Scanner) io.Reader {
+	return MixReaderWith(TimeRand(), nil, rs...)
+}
+
+func MixReaderWith(rg *rand.Rand, weights []int, rs ...Scanner) io.Reader {
 	vs := make([]Scanner, len(rs))
 	copy(vs, rs)
 
-	return &mixReaders{vs}
-}
-
-func (m *mixReaders) Read(bs []byte) (int, error) {
-	ix := rand.Intn(len(m.rs))
-	if !m.rs[ix].Scan() {
-		if len(m.rs) > 1 {
-			m.rs = append(m.rs[:ix], m.rs[ix+1:]...)
-			ix = (ix + 1) % len(m.rs)
+	ws := make([]int, len(rs))
+	for i := range ws {
+		if i < len(weights) && weights[i] > 0 {
+			ws[i] = weights[i]
 		} else {
-			return 0, io.EOF
+			ws[i] = 1
 		}
 	}
-	return copy(bs, m.rs[ix].Bytes()), m.rs[ix].Err()
-}
-
-type noDuplicateWriter struct {
-	sums  map[[md5.Size]byte]struct{}
-	inner io.Writer
+	return &mixReaders{rand: rg, rs: vs, weights: ws}
 }
 
-func NoDuplicate(w io.Writer) io.Writer {
-	return &noDuplicateWriter{
-		sums:  make(map[[md5.Size]byte]struct{}),
-		inner: w,
+func (m *mixReaders) Read(bs []byte) (int, error) {
+	for len(m.rs) > 0 {
+		ix := m.pick()
+		if m.rs[ix].Scan() {
+			return copy(bs, m.rs[ix].Bytes()), nil
+		}
+		if err := m.rs[ix].Err(); err != nil {
+			return 0, err
+		}
+		m.rs = append(m.rs[:ix], m.rs[ix+1:]...)
+		m.weights = append(m.weights[:ix], m.weights[ix+1:]...)
 	}
+	return 0, io.EOF
 }
 
-func (w *noDuplicateWriter) Write(bs []byte) (int, error) {
-	sum := md5.Sum(bs)
-	if _, ok := w.sums[sum]; ok {
-		return len(bs), nil
+func (m *mixReaders) pick() int {
+	var total int
+	for _, w := range m.weights {
+		total += w
+	}
+	n := m.rand.Intn(total)
+	for i, w := range m.weights {
+		if n < w {
+			return i
+		}
+		n -= w
 	}
-	w.sums[sum] = struct{}{}
-	return w.inner.Write(bs)
+	return len(m.weights) - 1
 }
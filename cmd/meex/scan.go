@@ -10,7 +10,9 @@ import (
 	"hash"
 	"hash/adler32"
 	"io"
+	"math"
 	"os"
+	"sort"
 	"strings"
 	"time"
 	"unicode"
@@ -19,7 +21,29 @@ import (
 	"github.com/midbel/xxh"
 )
 
-var ErrShortBuffer = errors.New("need more bytes")
+var (
+	ErrShortBuffer = errors.New("need more bytes")
+	ErrTruncated   = errors.New("truncated packet")
+	ErrInvalidSize = errors.New("invalid packet size")
+)
+
+type PacketError struct {
+	File      string
+	Offset    int64
+	Err       error
+	Corrupted bool
+}
+
+func (e *PacketError) Error() string {
+	if e.File == "" {
+		return fmt.Sprintf("offset %d: %s", e.Offset, e.Err)
+	}
+	return fmt.Sprintf("%s: offset %d: %s", e.File, e.Offset, e.Err)
+}
+
+func (e *PacketError) Unwrap() error {
+	return e.Err
+}
 
 const Leap = 18 * time.Second
 
@@ -32,6 +56,10 @@ const (
 	CCSDSHeaderLen = 6
 	ESAHeaderLen   = 10
 	UMIHeaderLen   = 25
+
+	VMUCommonHeaderLen = 24
+	VMUImageHeaderLen  = 20
+	UPILen             = 32
 )
 
 var (
@@ -48,6 +76,54 @@ func DecodeById(id int, d Decoder) Decoder {
 	return &byId{id, d}
 }
 
+func (i *byId) ForFile() Decoder {
+	return &byId{i.id, decoderOf(i.inner)}
+}
+
+func (i *byId) Framing() Framer {
+	return framerOf(i.inner)
+}
+
+func (i *byId) Demux() *Demux {
+	return demuxOf(i.inner)
+}
+
+type byService struct {
+	service Service
+	inner   Decoder
+}
+
+func DecodeByService(s Service, d Decoder) Decoder {
+	if s.Service < 0 {
+		return d
+	}
+	return &byService{s, d}
+}
+
+func (s *byService) ForFile() Decoder {
+	return &byService{s.service, decoderOf(s.inner)}
+}
+
+func (s *byService) Framing() Framer {
+	return framerOf(s.inner)
+}
+
+func (s *byService) Demux() *Demux {
+	return demuxOf(s.inner)
+}
+
+func (s *byService) Decode(bs []byte) (Packet, error) {
+	p, err := s.inner.Decode(bs)
+	if err != nil {
+		return p, err
+	}
+	t, ok := p.(*TMPacket)
+	if !ok || t.PUS == nil || !s.service.Match(t.Service()) {
+		return nil, ErrSkip
+	}
+	return p, nil
+}
+
 func (i *byId) Decode(bs []byte) (Packet, error) {
 	// if i.inner.Decode == nil {
 	if i.inner == nil {
@@ -66,6 +142,59 @@ func (i *byId) Decode(bs []byte) (Packet, error) {
 	return p, nil
 }
 
+type Framer struct {
+	Header int
+	Length func([]byte) int
+}
+
+var (
+	sizeFramer = Framer{
+		Header: 4,
+		Length: func(bs []byte) int {
+			return int(binary.LittleEndian.Uint32(bs)) + 4
+		},
+	}
+	ccsdsFramer = Framer{
+		Header: CCSDSHeaderLen,
+		Length: func(bs []byte) int {
+			return int(binary.BigEndian.Uint16(bs[4:])) + 1 + CCSDSHeaderLen
+		},
+	}
+)
+
+type Framed interface {
+	Framing() Framer
+}
+
+// FileDecoder is implemented by the decoders keeping a state for the file
+// being read (eg: the packet type detected by DecodeAuto).
+type FileDecoder interface {
+	ForFile() Decoder
+}
+
+func decoderOf(d Decoder) Decoder {
+	if f, ok := d.(FileDecoder); ok {
+		return f.ForFile()
+	}
+	return d
+}
+
+func framerOf(d Decoder) Framer {
+	if f, ok := d.(Framed); ok {
+		return f.Framing()
+	}
+	return sizeFramer
+}
+
+type framedDecoder struct {
+	Decoder
+	framer Framer
+}
+
+func (f framedDecoder) Framing() Framer {
+	return f.framer
+}
+
 type DecoderFunc func([]byte) (Packet, error)
 
 func (d DecoderFunc) Decode(bs []byte) (Packet, error) {
@@ -156,33 +285,84 @@ func (u *UMIHeader) UnmarshalBinary(bs []byte) error {
 	if u == nil {
 		u = new(UMIHeader)
 	}
-	var (
-		coarse uint32
-		fine   uint8
-	)
 	if len(bs) < UMIHeaderLen {
 		return ErrShortBuffer
 	}
-	r := bytes.NewReader(bs)
-	binary.Read(r, binary.LittleEndian, &u.Size)
-	binary.Read(r, binary.BigEndian, &u.State)
-	binary.Read(r, binary.BigEndian, &u.Orbit)
-	io.ReadFull(r, u.Code[:])
-	binary.Read(r, binary.BigEndian, &u.Type)
-	binary.Read(r, binary.BigEndian, &u.Unit)
-	binary.Read(r, binary.BigEndian, &coarse)
-	binary.Read(r, binary.BigEndian, &fine)
-	binary.Read(r, binary.BigEndian, &u.Len)
-
-	u.Acquisition = timutil.Join5(coarse, fine)
+	u.Size = binary.LittleEndian.Uint32(bs)
+	u.State = UMIPacketState(bs[4])
+	u.Orbit = binary.BigEndian.Uint32(bs[5:])
+	copy(u.Code[:], bs[9:])
+	u.Type = UMIValueType(bs[15])
+	u.Unit = binary.BigEndian.Uint16(bs[16:])
+	u.Acquisition = timutil.Join5(binary.BigEndian.Uint32(bs[18:]), bs[22])
+	u.Len = binary.BigEndian.Uint16(bs[23:])
+
 	return nil
 }
 
+func (u *UMIHeader) MarshalBinary() ([]byte, error) {
+	var w bytes.Buffer
+	coarse, fine := timutil.Split5(u.Acquisition)
+
+	binary.Write(&w, binary.LittleEndian, u.Size)
+	binary.Write(&w, binary.BigEndian, u.State)
+	binary.Write(&w, binary.BigEndian, u.Orbit)
+	w.Write(u.Code[:])
+	binary.Write(&w, binary.BigEndian, u.Type)
+	binary.Write(&w, binary.BigEndian, u.Unit)
+	binary.Write(&w, binary.BigEndian, coarse)
+	binary.Write(&w, binary.BigEndian, fine)
+	binary.Write(&w, binary.BigEndian, u.Len)
+
+	return w.Bytes(), nil
+}
+
 type PDPacket struct {
 	UMI     *UMIHeader
 	Payload []byte
 }
 
+// Value returns the value carried by the packet according to its UMI type.
+// Integers are returned as int64, reals as float64 and bits as uint64.
+func (p *PDPacket) Value() (interface{}, error) {
+	n := int(p.UMI.Len)
+	if n > len(p.Payload)-UMIHeaderLen {
+		return nil, ErrShortBuffer
+	}
+	bs := p.Payload[len(p.Payload)-n:]
+	switch p.UMI.Type {
+	case Int32, Long:
+		if n == 0 || n > 8 {
+			return nil, fmt.Errorf("invalid integer length %d", n)
+		}
+		var v uint64
+		for _, b := range bs {
+			v = v<<8 | uint64(b)
+		}
+		shift := uint(64 - 8*n)
+		return int64(v<<shift) >> shift, nil
+	case Float64, Real, Exponent, Decimal:
+		switch n {
+		case 4:
+			return float64(math.Float32frombits(binary.BigEndian.Uint32(bs))), nil
+		case 8:
+			return math.Float64frombits(binary.BigEndian.Uint64(bs)), nil
+		default:
+			return nil, fmt.Errorf("invalid real length %d", n)
+		}
+	case Bit:
+		var v uint64
+		for _, b := range bs {
+			v = v<<8 | uint64(b)
+		}
+		return v, nil
+	case String8, StringN:
+		return strings.TrimRight(string(bs), "\x00 "), nil
+	default:
+		return nil, fmt.Errorf("%s values are not supported", p.UMI.Type)
+	}
+}
+
 func DecodePD() Decoder {
 	f := func(bs []byte) (Packet, error) {
 		if len(bs) < UMIHeaderLen {
@@ -287,21 +467,25 @@ func (p *PTHHeader) UnmarshalBinary(bs []byte) error {
 	if len(bs) < PTHHeaderLen {
 		return ErrShortBuffer
 	}
-	r := bytes.NewReader(bs)
-	var (
-		coarse uint32
-		fine   uint8
-	)
-	binary.Read(r, binary.LittleEndian, &p.Size)
-	binary.Read(r, binary.LittleEndian, &p.Type)
-	binary.Read(r, binary.BigEndian, &coarse)
-	binary.Read(r, binary.BigEndian, &fine)
-
-	p.Reception = timutil.Join5(coarse, fine)
+	p.Size = binary.LittleEndian.Uint32(bs)
+	p.Type = bs[4]
+	p.Reception = timutil.Join5(binary.BigEndian.Uint32(bs[5:]), bs[9])
 
 	return nil
 }
 
+func (p *PTHHeader) MarshalBinary() ([]byte, error) {
+	var w bytes.Buffer
+	coarse, fine := timutil.Split5(p.Reception)
+
+	binary.Write(&w, binary.LittleEndian, p.Size)
+	binary.Write(&w, binary.LittleEndian, p.Type)
+	binary.Write(&w, binary.BigEndian, coarse)
+	binary.Write(&w, binary.BigEndian, fine)
+
+	return w.Bytes(), nil
+}
+
 type CCSDSHeader struct {
 	Version  uint16
 	Fragment uint16
@@ -312,15 +496,26 @@ func (c *CCSDSHeader) UnmarshalBinary(bs []byte) error {
 	if c == nil {
 		c = new(CCSDSHeader)
 	}
-	r := bytes.NewReader(bs)
-
-	binary.Read(r, binary.BigEndian, &c.Version)
-	binary.Read(r, binary.BigEndian, &c.Fragment)
-	binary.Read(r, binary.BigEndian, &c.Length)
+	if len(bs) < CCSDSHeaderLen {
+		return ErrShortBuffer
+	}
+	c.Version = binary.BigEndian.Uint16(bs)
+	c.Fragment = binary.BigEndian.Uint16(bs[2:])
+	c.Length = binary.BigEndian.Uint16(bs[4:])
 
 	return nil
 }
 
+func (c *CCSDSHeader) MarshalBinary() ([]byte, error) {
+	var w bytes.Buffer
+
+	binary.Write(&w, binary.BigEndian, c.Version)
+	binary.Write(&w, binary.BigEndian, c.Fragment)
+	binary.Write(&w, binary.BigEndian, c.Length)
+
+	return w.Bytes(), nil
+}
+
 func (c *CCSDSHeader) Apid() int {
 	return int(c.Version & 0x07FF)
 }
@@ -329,6 +524,90 @@ func (c *CCSDSHeader) Sequence() int {
 	return int(c.Fragment & 0x3FFF)
 }
 
+func (c *CCSDSHeader) VersionNumber() int {
+	return int(c.Version >> 13)
+}
+
+func (c *CCSDSHeader) Type() int {
+	return int(c.Version>>12) & 0x01
+}
+
+func (c *CCSDSHeader) HasSecondary() bool {
+	return c.Version&0x0800 == 0x0800
+}
+
+func (c *CCSDSHeader) Segmentation() int {
+	return int(c.Fragment >> 14)
+}
+
+func (c *CCSDSHeader) Size() int {
+	return int(c.Length) + 1 + CCSDSHeaderLen
+}
+
+const (
+	SegmentContinuation = iota
+	SegmentFirst
+	SegmentLast
+	SegmentUnsegmented
+)
+
+type CCSDSError uint8
+
+const (
+	ErrCCSDSLength CCSDSError = 1 << iota
+	ErrCCSDSVersion
+	ErrCCSDSType
+	ErrCCSDSSecondary
+	ErrCCSDSSegment
+	ErrCCSDSControl
+)
+
+var ccsdsErrors = []struct {
+	Err  CCSDSError
+	Name string
+}{
+	{ErrCCSDSLength, "length"},
+	{ErrCCSDSVersion, "version"},
+	{ErrCCSDSType, "type"},
+	{ErrCCSDSSecondary, "secondary"},
+	{ErrCCSDSSegment, "segment"},
+	{ErrCCSDSControl, "crc"},
+}
+
+func (e CCSDSError) Categories() []string {
+	var vs []string
+	for _, c := range ccsdsErrors {
+		if e&c.Err != 0 {
+			vs = append(vs, c.Name)
+		}
+	}
+	return vs
+}
+
+func (e CCSDSError) String() string {
+	if e == 0 {
+		return "ok"
+	}
+	return strings.Join(e.Categories(), ",")
+}
+
+// CRC16 computes the CRC-16-CCITT (poly 0x1021, initial value 0xFFFF) used
+// by the CCSDS packet error control field.
+func CRC16(bs []byte) uint16 {
+	crc := uint16(0xFFFF)
+	for _, b := range bs {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
 type ESAPacketType uint8
 
 const (
@@ -413,34 +692,109 @@ func (e *ESAHeader) UnmarshalBinary(bs []byte) error {
 	if len(bs) < ESAHeaderLen {
 		return ErrShortBuffer
 	}
-	r := bytes.NewReader(bs)
+	e.Acquisition = timutil.Join5(binary.BigEndian.Uint32(bs), bs[4])
+	e.Info = bs[5]
+	e.Source = binary.BigEndian.Uint32(bs[6:])
 
-	var (
-		coarse uint32
-		fine   uint8
-	)
-	binary.Read(r, binary.BigEndian, &coarse)
-	binary.Read(r, binary.BigEndian, &fine)
-	binary.Read(r, binary.BigEndian, &e.Info)
-	binary.Read(r, binary.BigEndian, &e.Source)
+	return nil
+}
 
-	e.Acquisition = timutil.Join5(coarse, fine)
+func (e *ESAHeader) MarshalBinary() ([]byte, error) {
+	var w bytes.Buffer
+	coarse, fine := timutil.Split5(e.Acquisition)
 
-	return nil
+	binary.Write(&w, binary.BigEndian, coarse)
+	binary.Write(&w, binary.BigEndian, fine)
+	binary.Write(&w, binary.BigEndian, e.Info)
+	binary.Write(&w, binary.BigEndian, e.Source)
+
+	return w.Bytes(), nil
 }
 
 func (e *ESAHeader) PacketType() ESAPacketType {
 	return ESAPacketType(e.Info & 0xF)
 }
 
+const PUSHeaderLen = 3
+
+type PUSHeader struct {
+	Version uint8
+	Service uint8
+	Subtype uint8
+}
+
+func (p *PUSHeader) UnmarshalBinary(bs []byte) error {
+	if len(bs) < PUSHeaderLen {
+		return ErrShortBuffer
+	}
+	p.Version = (bs[0] >> 4) & 0x07
+	p.Service = bs[1]
+	p.Subtype = bs[2]
+	return nil
+}
+
+func (p *PUSHeader) MarshalBinary() ([]byte, error) {
+	return []byte{p.Version << 4, p.Service, p.Subtype}, nil
+}
+
+func (p *PUSHeader) String() string {
+	return fmt.Sprintf("%d/%d", p.Service, p.Subtype)
+}
+
+// TMOptions configures the decoding of CCSDS packets: PEC for the packet error
+// control and PUS for the PUS data field header, decoded for every packet or
+// only for the packets of Apids.
+type TMOptions struct {
+	PEC   bool
+	PUS   bool
+	Apids []int
+}
+
+// decodePUS returns the PUS data field header of the packet of apid if the
+// options ask for it.
+func (o TMOptions) decodePUS(apid int, bs []byte) *PUSHeader {
+	if !o.PUS {
+		return nil
+	}
+	if len(o.Apids) > 0 {
+		i := sort.SearchInts(o.Apids, apid)
+		if i >= len(o.Apids) || o.Apids[i] != apid {
+			return nil
+		}
+	}
+	return decodePUS(bs)
+}
+
+// decodePUS returns the PUS data field header found at the start of the user
+// data. Only PUS versions 1 and 2 are recognized, any other value means that
+// the packet does not carry a PUS header.
+func decodePUS(bs []byte) *PUSHeader {
+	var p PUSHeader
+	if err := p.UnmarshalBinary(bs); err != nil {
+		return nil
+	}
+	if p.Version != 1 && p.Version != 2 {
+		return nil
+	}
+	return &p
+}
+
 type TMPacket struct {
 	PTH     *PTHHeader
 	CCSDS   *CCSDSHeader
 	ESA     *ESAHeader
+	PUS     *PUSHeader
 	Payload []byte
+	PEC     bool
+	// Services is set when the packet is decoded with the pus option.
+	Services bool
 }
 
 func DecodeTM() Decoder {
+	return DecodeTMWith(TMOptions{})
+}
+
+func DecodeTMWith(o TMOptions) Decoder {
 	f := func(bs []byte) (Packet, error) {
 		if len(bs) < PTHHeaderLen+CCSDSHeaderLen+ESAHeaderLen {
 			return nil, ErrShortBuffer
@@ -460,42 +814,142 @@ func DecodeTM() Decoder {
 			return nil, err
 		}
 		t := TMPacket{
-			PTH:     &p,
-			CCSDS:   &c,
-			ESA:     &e,
-			Payload: bs,
+			PTH:      &p,
+			CCSDS:    &c,
+			ESA:      &e,
+			PUS:      o.decodePUS(c.Apid(), bs[PTHHeaderLen+CCSDSHeaderLen+ESAHeaderLen:]),
+			Payload:  bs,
+			PEC:      o.PEC,
+			Services: o.PUS,
 		}
 		return &t, nil
 	}
 	return DecoderFunc(f)
 }
 
+func DecodeCCSDS(esa bool, o TMOptions) Decoder {
+	f := func(bs []byte) (Packet, error) {
+		if len(bs) < CCSDSHeaderLen {
+			return nil, ErrShortBuffer
+		}
+		var c CCSDSHeader
+		if err := c.UnmarshalBinary(bs); err != nil {
+			return nil, err
+		}
+		t := TMPacket{
+			CCSDS:    &c,
+			Payload:  bs,
+			PEC:      o.PEC,
+			Services: o.PUS,
+		}
+		if esa && c.Version&0x0800 != 0 {
+			var e ESAHeader
+			if err := e.UnmarshalBinary(bs[CCSDSHeaderLen:]); err != nil {
+				return nil, err
+			}
+			t.ESA = &e
+			t.PUS = o.decodePUS(c.Apid(), bs[CCSDSHeaderLen+ESAHeaderLen:])
+		}
+		return &t, nil
+	}
+	return framedDecoder{
+		Decoder: DecoderFunc(f),
+		framer:  ccsdsFramer,
+	}
+}
+
 func (t *TMPacket) Error() bool {
-	return false
+	return t.Check() != 0
+}
+
+func (t *TMPacket) Check() CCSDSError {
+	var e CCSDSError
+	bs := t.Payload[t.offset():]
+	if t.CCSDS.Size() != len(bs) {
+		e |= ErrCCSDSLength
+	}
+	if t.CCSDS.VersionNumber() != 0 {
+		e |= ErrCCSDSVersion
+	}
+	if t.CCSDS.Type() != 0 {
+		e |= ErrCCSDSType
+	}
+	if t.ESA != nil && !t.CCSDS.HasSecondary() {
+		e |= ErrCCSDSSecondary
+	}
+	if t.PEC && e&ErrCCSDSLength == 0 {
+		z := len(bs) - 2
+		if z < CCSDSHeaderLen || CRC16(bs[:z]) != binary.BigEndian.Uint16(bs[z:]) {
+			e |= ErrCCSDSControl
+		}
+	}
+	return e
 }
 
 func (t *TMPacket) PacketInfo() *Info {
+	offset := t.offset()
+	service, subtype := t.Service()
 	return &Info{
 		Id:       t.CCSDS.Apid(),
 		Sequence: t.Sequence(),
-		Size:     len(t.Payload) - PTHHeaderLen,
+		Size:     len(t.Payload) - offset,
 		AcqTime:  t.Timestamp(),
-		Sum:      adler32.Checksum(t.Payload[PTHHeaderLen:]),
-		Context:  t.ESA.PacketType().String(),
+		Sum:      adler32.Checksum(t.Payload[offset:]),
+		Context:  t.PacketType().String(),
 		Type:     "tm",
+		Service:  service,
+		Subtype:  subtype,
+		Source:   t.Source(),
+	}
+}
+
+func (t *TMPacket) Service() (int, int) {
+	if t.PUS == nil {
+		return 0, 0
 	}
+	return int(t.PUS.Service), int(t.PUS.Subtype)
+}
+
+func (t *TMPacket) Source() int {
+	if t.ESA == nil {
+		return 0
+	}
+	return int(t.ESA.Source)
+}
+
+func (t *TMPacket) PacketType() ESAPacketType {
+	if t.ESA == nil {
+		return Default
+	}
+	return t.ESA.PacketType()
 }
 
 func (t *TMPacket) Timestamp() time.Time {
+	if t.ESA == nil {
+		return t.Reception()
+	}
 	return t.ESA.Acquisition
 }
 
 func (t *TMPacket) Reception() time.Time {
+	if t.PTH == nil {
+		if t.ESA == nil {
+			return time.Time{}
+		}
+		return t.ESA.Acquisition
+	}
 	return t.PTH.Reception
 }
 
 func (t *TMPacket) Id() (int, int) {
-	return t.CCSDS.Apid(), int(t.ESA.Source)
+	return t.CCSDS.Apid(), t.Source()
+}
+
+func (t *TMPacket) offset() int {
+	if t.PTH == nil {
+		return 0
+	}
+	return PTHHeaderLen
 }
 
 func (t *TMPacket) Sequence() int {
@@ -550,25 +1004,33 @@ func (h *HRDLHeader) UnmarshalBinary(bs []byte) error {
 	if len(bs) < HRDLHeaderLen {
 		return ErrShortBuffer
 	}
-	var (
-		coarse uint32
-		fine   uint8
-	)
-	r := bytes.NewReader(bs)
-	binary.Read(r, binary.LittleEndian, &h.Size)
-	binary.Read(r, binary.BigEndian, &h.Error)
-	binary.Read(r, binary.BigEndian, &h.Payload)
-	binary.Read(r, binary.BigEndian, &h.Channel)
+	h.Size = binary.LittleEndian.Uint32(bs)
+	h.Error = binary.BigEndian.Uint16(bs[4:])
+	h.Payload = bs[6]
+	h.Channel = bs[7]
+	h.Acquisition = timutil.Join5(binary.BigEndian.Uint32(bs[8:]), bs[12])
+	h.Reception = timutil.Join5(binary.BigEndian.Uint32(bs[13:]), bs[17])
 
-	binary.Read(r, binary.BigEndian, &coarse)
-	binary.Read(r, binary.BigEndian, &fine)
-	h.Acquisition = timutil.Join5(coarse, fine)
+	return nil
+}
 
-	binary.Read(r, binary.BigEndian, &coarse)
-	binary.Read(r, binary.BigEndian, &fine)
-	h.Reception = timutil.Join5(coarse, fine)
+func (h *HRDLHeader) MarshalBinary() ([]byte, error) {
+	var w bytes.Buffer
 
-	return nil
+	binary.Write(&w, binary.LittleEndian, h.Size)
+	binary.Write(&w, binary.BigEndian, h.Error)
+	binary.Write(&w, binary.BigEndian, h.Payload)
+	binary.Write(&w, binary.BigEndian, h.Channel)
+
+	coarse, fine := timutil.Split5(h.Acquisition)
+	binary.Write(&w, binary.BigEndian, coarse)
+	binary.Write(&w, binary.BigEndian, fine)
+
+	coarse, fine = timutil.Split5(h.Reception)
+	binary.Write(&w, binary.BigEndian, coarse)
+	binary.Write(&w, binary.BigEndian, fine)
+
+	return w.Bytes(), nil
 }
 
 type VMUChannel uint8
@@ -597,7 +1059,7 @@ type VMUCommonHeader struct {
 	AuxTime  time.Duration
 	Stream   uint16
 	Counter  uint32
-	UPI      [32]byte
+	UPI      [UPILen]byte
 
 	Valid bool
 }
@@ -663,18 +1125,26 @@ func (v *VMUCommonHeader) Auxiliary() time.Time {
 }
 
 func (v *VMUCommonHeader) String() string {
-	bs := bytes.Trim(v.UPI[:], "\x00")
-	if len(bs) > 0 {
-		return strings.Map(func(r rune) rune {
-			if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-' || r == '_' {
-				return r
-			}
-			return '*'
-		}, string(bs))
+	if upi := v.RawUPI(); upi != "" {
+		return maskUPI(upi)
 	}
 	return v.Type()
 }
 
+// RawUPI returns the UPI without its padding nor masking.
+func (v *VMUCommonHeader) RawUPI() string {
+	return string(bytes.Trim(v.UPI[:], "\x00"))
+}
+
+func maskUPI(upi string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-' || r == '_' {
+			return r
+		}
+		return '*'
+	}, upi)
+}
+
 func (v *VMUCommonHeader) Type() string {
 	switch v.Property >> 4 {
 	case 1:
@@ -695,36 +1165,77 @@ type VMUImageHeader struct {
 	Force   uint8
 }
 
+func (v *VMUCommonHeader) decode(bs []byte) {
+	v.Property = bs[0]
+	v.Stream = binary.LittleEndian.Uint16(bs[1:])
+	v.Counter = binary.LittleEndian.Uint32(bs[3:])
+	v.AcqTime = time.Duration(binary.LittleEndian.Uint64(bs[7:]))
+	v.AuxTime = time.Duration(binary.LittleEndian.Uint64(bs[15:]))
+	v.Origin = bs[23]
+}
+
+func (v *VMUCommonHeader) MarshalBinary() ([]byte, error) {
+	var w bytes.Buffer
+
+	binary.Write(&w, binary.LittleEndian, v.Property)
+	binary.Write(&w, binary.LittleEndian, v.Stream)
+	binary.Write(&w, binary.LittleEndian, v.Counter)
+	binary.Write(&w, binary.LittleEndian, v.AcqTime)
+	binary.Write(&w, binary.LittleEndian, v.AuxTime)
+	binary.Write(&w, binary.LittleEndian, v.Origin)
+
+	return w.Bytes(), nil
+}
+
+func (v *VMUImageHeader) MarshalBinary() ([]byte, error) {
+	var w bytes.Buffer
+
+	binary.Write(&w, binary.LittleEndian, v.Format)
+	binary.Write(&w, binary.LittleEndian, v.Pixels)
+	binary.Write(&w, binary.LittleEndian, v.Region)
+	binary.Write(&w, binary.LittleEndian, v.Drop)
+	binary.Write(&w, binary.LittleEndian, v.Scaling)
+	binary.Write(&w, binary.LittleEndian, v.Force)
+
+	return w.Bytes(), nil
+}
+
 type Image struct {
 	*VMUCommonHeader
 	*VMUImageHeader
 	Payload []byte
+
+	record []byte
+}
+
+// MarshalBinary encodes the headers of the image followed by its UPI as read
+// by decodeImage.
+func (i *Image) MarshalBinary() ([]byte, error) {
+	c, _ := i.VMUCommonHeader.MarshalBinary()
+	s, _ := i.VMUImageHeader.MarshalBinary()
+	return append(append(c, s...), i.UPI[:]...), nil
 }
 
 func decodeImage(bs []byte, valid bool) (*Image, error) {
-	r := bytes.NewReader(bs)
+	const size = VMUCommonHeaderLen + VMUImageHeaderLen + UPILen
+	if len(bs) < size {
+		return nil, ErrShortBuffer
+	}
 	var (
 		c VMUCommonHeader
 		s VMUImageHeader
 	)
+	c.decode(bs)
 
-	binary.Read(r, binary.LittleEndian, &c.Property)
-	binary.Read(r, binary.LittleEndian, &c.Stream)
-	binary.Read(r, binary.LittleEndian, &c.Counter)
-	binary.Read(r, binary.LittleEndian, &c.AcqTime)
-	binary.Read(r, binary.LittleEndian, &c.AuxTime)
-	binary.Read(r, binary.LittleEndian, &c.Origin)
-
-	binary.Read(r, binary.LittleEndian, &s.Format)
-	binary.Read(r, binary.LittleEndian, &s.Pixels)
-	binary.Read(r, binary.LittleEndian, &s.Region)
-	binary.Read(r, binary.LittleEndian, &s.Drop)
-	binary.Read(r, binary.LittleEndian, &s.Scaling)
-	binary.Read(r, binary.LittleEndian, &s.Force)
-
-	if _, err := io.ReadFull(r, c.UPI[:]); err != nil {
-		return nil, err
-	}
+	vs := bs[VMUCommonHeaderLen:]
+	s.Format = vs[0]
+	s.Pixels = binary.LittleEndian.Uint32(vs[1:])
+	s.Region = binary.LittleEndian.Uint64(vs[5:])
+	s.Drop = binary.LittleEndian.Uint16(vs[13:])
+	s.Scaling = binary.LittleEndian.Uint32(vs[15:])
+	s.Force = vs[19]
+
+	copy(c.UPI[:], bs[VMUCommonHeaderLen+VMUImageHeaderLen:])
 	c.Valid = valid
 
 	i := Image{
@@ -755,6 +1266,11 @@ func (i *Image) Bytes() []byte {
 	return i.Payload
 }
 
+// Record gives the VMU packet the image was decoded from.
+func (i *Image) Record() []byte {
+	return i.record
+}
+
 func (i *Image) Export(w io.Writer) error {
 	return nil
 }
@@ -762,22 +1278,24 @@ func (i *Image) Export(w io.Writer) error {
 type Table struct {
 	*VMUCommonHeader
 	Payload []byte
+
+	record []byte
 }
 
-func decodeTable(bs []byte, valid bool) (*Table, error) {
-	r := bytes.NewReader(bs)
+// MarshalBinary encodes the header of the table followed by its UPI as read
+// by decodeTable.
+func (t *Table) MarshalBinary() ([]byte, error) {
+	c, _ := t.VMUCommonHeader.MarshalBinary()
+	return append(c, t.UPI[:]...), nil
+}
 
-	var c VMUCommonHeader
-	binary.Read(r, binary.LittleEndian, &c.Property)
-	binary.Read(r, binary.LittleEndian, &c.Stream)
-	binary.Read(r, binary.LittleEndian, &c.Counter)
-	binary.Read(r, binary.LittleEndian, &c.AcqTime)
-	binary.Read(r, binary.LittleEndian, &c.AuxTime)
-	binary.Read(r, binary.LittleEndian, &c.Origin)
-
-	if _, err := io.ReadFull(r, c.UPI[:]); err != nil {
-		return nil, err
+func decodeTable(bs []byte, valid bool) (*Table, error) {
+	if len(bs) < VMUCommonHeaderLen+UPILen {
+		return nil, ErrShortBuffer
 	}
+	var c VMUCommonHeader
+	c.decode(bs)
+	copy(c.UPI[:], bs[VMUCommonHeaderLen:])
 	c.Valid = valid
 
 	t := Table{
@@ -807,6 +1325,11 @@ func (t *Table) Bytes() []byte {
 	return t.Payload
 }
 
+// Record gives the VMU packet the table was decoded from.
+func (t *Table) Record() []byte {
+	return t.record
+}
+
 func (t *Table) Export(w io.Writer) error {
 	return nil
 }
@@ -827,26 +1350,34 @@ func (v *VMUHeader) UnmarshalBinary(bs []byte) error {
 	if len(bs) < VMUHeaderLen {
 		return ErrShortBuffer
 	}
+	v.Word = binary.LittleEndian.Uint32(bs)
+	v.Size = binary.LittleEndian.Uint32(bs[4:])
+	v.Channel = VMUChannel(bs[8])
+	v.Origin = bs[9]
+	v.Sequence = binary.LittleEndian.Uint32(bs[12:])
+	v.Acquisition = timutil.Join6(binary.LittleEndian.Uint32(bs[16:]), binary.LittleEndian.Uint16(bs[20:]))
+
+	return nil
+}
+
+func (v *VMUHeader) MarshalBinary() ([]byte, error) {
 	var (
-		spare  uint16
-		coarse uint32
-		fine   uint16
+		w     bytes.Buffer
+		spare uint16
 	)
+	coarse, fine := timutil.Split6(v.Acquisition)
 
-	r := bytes.NewReader(bs)
-	binary.Read(r, binary.LittleEndian, &v.Word)
-	binary.Read(r, binary.LittleEndian, &v.Size)
-	binary.Read(r, binary.LittleEndian, &v.Channel)
-	binary.Read(r, binary.LittleEndian, &v.Origin)
-	binary.Read(r, binary.LittleEndian, &spare)
-	binary.Read(r, binary.LittleEndian, &v.Sequence)
-	binary.Read(r, binary.LittleEndian, &coarse)
-	binary.Read(r, binary.LittleEndian, &fine)
-	binary.Read(r, binary.LittleEndian, &spare)
+	binary.Write(&w, binary.LittleEndian, v.Word)
+	binary.Write(&w, binary.LittleEndian, v.Size)
+	binary.Write(&w, binary.LittleEndian, v.Channel)
+	binary.Write(&w, binary.LittleEndian, v.Origin)
+	binary.Write(&w, binary.LittleEndian, spare)
+	binary.Write(&w, binary.LittleEndian, v.Sequence)
+	binary.Write(&w, binary.LittleEndian, coarse)
+	binary.Write(&w, binary.LittleEndian, fine)
+	binary.Write(&w, binary.LittleEndian, spare)
 
-	v.Acquisition = timutil.Join6(coarse, fine)
-
-	return nil
+	return w.Bytes(), nil
 }
 
 type VMUPacket struct {
@@ -855,13 +1386,38 @@ type VMUPacket struct {
 	Payload []byte
 	Sum     uint32
 	Control uint32
+
+	// origin of the common header of the HRD packet, -1 if there is none.
+	origin int
 }
 
 func DecodeVMU() Decoder {
 	return DecoderFunc(decodeVMU)
 }
 
+// DecodeVMUMode decodes VMU packets and skips the ones that are not of the
+// given mode (realtime or playback).
+func DecodeVMUMode(mode string) Decoder {
+	f := func(bs []byte) (Packet, error) {
+		p, err := decodeVMU(bs)
+		if err != nil {
+			return p, err
+		}
+		if v, ok := p.(*VMUPacket); ok && v.Mode() != mode {
+			return nil, ErrSkip
+		}
+		return p, nil
+	}
+	return DecoderFunc(f)
+}
+
 func DecodeHRD() Decoder {
+	return DecodeHRDMode("")
+}
+
+// DecodeHRDMode decodes the HRD packets carried by VMU packets of the given
+// mode. An empty mode accepts both realtime and playback packets.
+func DecodeHRDMode(mode string) Decoder {
 	f := func(bs []byte) (Packet, error) {
 		p, err := decodeVMU(bs)
 		if err != nil {
@@ -871,7 +1427,15 @@ func DecodeHRD() Decoder {
 		if !ok {
 			return nil, fmt.Errorf("can not decode VMU packet")
 		}
-		return v.Data()
+		if mode != "" && v.Mode() != mode {
+			return nil, ErrSkip
+		}
+		hr, err := v.Data()
+		if err == nil && hr == nil {
+			// the channel of v does not carry HRD packets
+			return nil, ErrSkip
+		}
+		return hr, err
 	}
 	return DecoderFunc(f)
 }
@@ -895,6 +1459,17 @@ func decodeVMU(bs []byte) (Packet, error) {
 		VMU:     &v,
 		Payload: bs,
 		Sum:     binary.LittleEndian.Uint32(bs[len(bs)-4:]),
+		origin:  -1,
+	}
+	size := HRDLHeaderLen + VMUHeaderLen + VMUCommonHeaderLen + UPILen
+	switch v.Channel {
+	case ChannelVic1, ChannelVic2:
+		size += VMUImageHeaderLen
+		fallthrough
+	case ChannelLRSD:
+		if len(bs) >= size {
+			p.origin = int(bs[HRDLHeaderLen+VMUHeaderLen+23])
+		}
 	}
 	for i := HRDLHeaderLen + 8; i < len(bs)-4; i++ {
 		p.Control += uint32(bs[i])
@@ -911,9 +1486,15 @@ func (v *VMUPacket) Data() (HRPacket, error) {
 	switch valid := v.Control == v.Sum; v.VMU.Channel {
 	default:
 	case ChannelVic1, ChannelVic2:
-		d, err = decodeImage(v.Payload[HRDLHeaderLen+VMUHeaderLen:], valid)
+		var i *Image
+		if i, err = decodeImage(v.Payload[HRDLHeaderLen+VMUHeaderLen:], valid); err == nil {
+			i.record, d = v.Payload, i
+		}
 	case ChannelLRSD:
-		d, err = decodeTable(v.Payload[HRDLHeaderLen+VMUHeaderLen:], valid)
+		var t *Table
+		if t, err = decodeTable(v.Payload[HRDLHeaderLen+VMUHeaderLen:], valid); err == nil {
+			t.record, d = v.Payload, t
+		}
 	}
 	return d, err
 }
@@ -933,9 +1514,36 @@ func (v *VMUPacket) PacketInfo() *Info {
 		AcqTime:  v.VMU.Acquisition,
 		Sum:      adler32.Checksum(v.Payload[HRDLHeaderLen:]),
 		Type:     "vmu",
+		Mode:     v.Mode(),
+	}
+}
+
+// Playback reports whether the packet was recorded on board and dumped later:
+// the origin of its HRD header differs from the origin of the VMU header.
+func (v *VMUPacket) Playback() bool {
+	return v.origin >= 0 && uint8(v.origin) != v.VMU.Origin
+}
+
+// Common returns the common header of the HRD packet carried by v or nil if
+// it can not be decoded.
+func (v *VMUPacket) Common() *VMUCommonHeader {
+	switch hr, _ := v.Data(); hr := hr.(type) {
+	case *Image:
+		return hr.VMUCommonHeader
+	case *Table:
+		return hr.VMUCommonHeader
+	default:
+		return nil
 	}
 }
 
+func (v *VMUPacket) Mode() string {
+	if v.Playback() {
+		return ModePlayback
+	}
+	return ModeRealtime
+}
+
 func (v *VMUPacket) Timestamp() time.Time {
 	return v.VMU.Acquisition
 }
@@ -1018,21 +1626,29 @@ type Reader struct {
 	// reader *bufio.Reader
 
 	reader  io.Reader
+	kind    Decoder
 	decoder Decoder
+	framer  Framer
+	demux   *Demux
 	digest  hash.Hash
 
 	tmp    []byte
 	buffer []byte
 	offset int
+	pos    int64
 
 	queue chan Packet
+	errs  []*PacketError
 }
 
 const maxBufferSize = 32 << 20
 
 func NewReader(r io.Reader, d Decoder) *Reader {
 	rs := &Reader{
+		kind:    d,
 		decoder: d,
+		framer:  framerOf(d),
+		demux:   demuxOf(d),
 		digest:  xxh.New64(0),
 		buffer:  make([]byte, maxBufferSize),
 	}
@@ -1040,9 +1656,13 @@ func NewReader(r io.Reader, d Decoder) *Reader {
 	return rs
 }
 
+// Reset reads from rs. The frames demultiplexer is kept so that the packets
+// split over two files are rebuilt.
 func (r *Reader) Reset(rs io.Reader) {
 	r.digest.Reset()
 	r.reader = io.TeeReader(rs, r.digest)
+	r.pos, r.errs = 0, nil
+	r.decoder = decoderOf(r.kind)
 	// r.reader = rs
 }
 
@@ -1102,27 +1722,72 @@ func (r *Reader) Gaps() <-chan *Gap {
 }
 
 func (r *Reader) Next() (Packet, error) {
+	if r.demux != nil {
+		return r.demux.next(r.read, r.decoder)
+	}
+	pos, bs, err := r.read()
+	if err != nil {
+		return nil, err
+	}
+	return decodeAt(r.decoder, bs, pos)
+}
+
+func (r *Reader) read() (int64, []byte, error) {
+	pos, fr := r.pos, r.framer
 	if diff := maxBufferSize - r.offset; diff < 1024 {
 		r.offset = 0
 	}
-	if _, err := r.reader.Read(r.buffer[r.offset : r.offset+4]); err != nil {
-		return nil, err
+	if n, err := io.ReadFull(r.reader, r.buffer[r.offset:r.offset+fr.Header]); err != nil {
+		if err == io.EOF {
+			return pos, nil, err
+		}
+		r.pos += int64(n)
+		return pos, nil, &PacketError{Offset: pos, Err: ErrTruncated}
+	}
+	size := fr.Length(r.buffer[r.offset:])
+	if size <= fr.Header || size > MaxBufferSize {
+		return pos, nil, &PacketError{Offset: pos, Err: fmt.Errorf("%w (%d bytes)", ErrInvalidSize, size-fr.Header)}
 	}
-	size := int(binary.LittleEndian.Uint32(r.buffer[r.offset:]))
-	if diff := maxBufferSize - (r.offset + 4); size >= diff {
-		copy(r.buffer, r.buffer[r.offset:r.offset+4])
+	if diff := maxBufferSize - r.offset; size >= diff {
+		copy(r.buffer, r.buffer[r.offset:r.offset+fr.Header])
 		r.offset = 0
 	}
 
-	if _, err := r.reader.Read(r.buffer[r.offset+4 : r.offset+size+4]); err != nil {
-		return nil, err
+	n, err := io.ReadFull(r.reader, r.buffer[r.offset+fr.Header:r.offset+size])
+	r.pos += int64(n + fr.Header)
+	if err != nil {
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			err = ErrTruncated
+		}
+		return pos, nil, &PacketError{Offset: pos, Err: err}
 	}
-	if r.decoder == nil {
+	offset := r.offset
+	r.offset += size
+	return pos, r.buffer[offset : offset+size], nil
+}
+
+func decodeAt(d Decoder, bs []byte, pos int64) (Packet, error) {
+	if d == nil {
 		return nil, ErrSkip
 	}
-	offset := r.offset
-	r.offset += size + 4
-	return r.decoder.Decode(r.buffer[offset : offset+size+4])
+	p, err := d.Decode(bs)
+	if err != nil && err != ErrSkip {
+		return nil, &PacketError{Offset: pos, Err: err, Corrupted: true}
+	}
+	return p, err
+}
+
+func (r *Reader) Err() error {
+	for _, e := range r.errs {
+		if !e.Corrupted {
+			return e
+		}
+	}
+	return nil
+}
+
+func (r *Reader) Errors() []*PacketError {
+	return r.errs
 }
 
 func (r *Reader) Packets() <-chan Packet {
@@ -1140,11 +1805,18 @@ func (r *Reader) packets() {
 	}()
 	for {
 		p, err := r.Next()
-		if err == io.EOF {
-			return
-		}
-		if err == nil {
+		switch e := err.(type) {
+		case nil:
 			r.queue <- p
+		case *PacketError:
+			r.errs = append(r.errs, e)
+			if !e.Corrupted {
+				return
+			}
+		default:
+			if err != ErrSkip {
+				return
+			}
 		}
 	}
 }
@@ -1181,6 +1853,5 @@ func scanPackets(bs []byte, ateof bool) (int, []byte, error) {
 	if len(bs) < size {
 		return 0, nil, nil
 	}
-	vs := make([]byte, size)
-	return copy(vs, bs[:size]), vs, nil
+	return size, bs[:size], nil
 }
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// MaxSeenPackets is the number of packets per key recorded in a state file
+// to recognize the packets already processed when a run is restarted.
+const MaxSeenPackets = 1024
+
+// State keeps the last packet seen per key so that gaps and counts can be
+// computed incrementally over several runs (eg: one per day).
+//
+// A state loaded from a file skips the packets already processed by the run
+// that saved it (same key, timestamp and sequence among the last packets of
+// each key) and gives back the buckets a Counter left open.
+type State struct {
+	last  map[string]Packet
+	owned map[string]struct{}
+
+	persist bool
+	seen    map[string]*seenRing
+	prev    map[string]map[seenPacket]struct{}
+	counter *counterState
+}
+
+type seenPacket struct {
+	When     int64 `json:"when"`
+	Sequence int   `json:"sequence"`
+}
+
+type seenRing struct {
+	seen []seenPacket
+	next int
+}
+
+func (r *seenRing) add(p seenPacket) {
+	if len(r.seen) < MaxSeenPackets {
+		r.seen = append(r.seen, p)
+		return
+	}
+	r.seen[r.next] = p
+	r.next = (r.next + 1) % len(r.seen)
+}
+
+type stateEntry struct {
+	Key    string       `json:"key"`
+	Family string       `json:"family"`
+	Packet []byte       `json:"packet"`
+	Seen   []seenPacket `json:"seen,omitempty"`
+}
+
+type stateBucket struct {
+	Key  string    `json:"key"`
+	When time.Time `json:"when"`
+	Coze Coze      `json:"coze"`
+	Run  uint64    `json:"run,omitempty"`
+}
+
+func newStateBucket(k *KeyTimeCoze) *stateBucket {
+	return &stateBucket{
+		Key:  k.Key,
+		When: k.When,
+		Coze: *k.Coze,
+		Run:  k.run,
+	}
+}
+
+func (b *stateBucket) keyTimeCoze() *KeyTimeCoze {
+	c := b.Coze
+	c.run = b.Run
+	return &KeyTimeCoze{
+		Coze: &c,
+		Key:  b.Key,
+		When: b.When,
+	}
+}
+
+type counterState struct {
+	Latest time.Time      `json:"latest"`
+	Mark   time.Time      `json:"mark"`
+	Open   []*stateBucket `json:"open,omitempty"`
+	Last   []*stateBucket `json:"last,omitempty"`
+}
+
+type stateFile struct {
+	Keys    []stateEntry  `json:"keys"`
+	Counter *counterState `json:"counter,omitempty"`
+}
+
+func NewState() *State {
+	return &State{
+		last:  make(map[string]Packet),
+		owned: make(map[string]struct{}),
+		seen:  make(map[string]*seenRing),
+		prev:  make(map[string]map[seenPacket]struct{}),
+	}
+}
+
+// LoadState reads the state saved in file. A missing file gives an empty
+// state.
+func LoadState(file string) (*State, error) {
+	s := NewState()
+	s.persist = true
+	r, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var sf stateFile
+	if err := json.NewDecoder(r).Decode(&sf); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	for _, e := range sf.Keys {
+		f, err := Lookup(e.Family)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		p, err := f.Decoder().Decode(e.Packet)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s: %w", file, e.Key, err)
+		}
+		s.last[e.Key], s.owned[e.Key] = p, struct{}{}
+		s.seen[e.Key] = &seenRing{seen: e.Seen}
+		ps := make(map[seenPacket]struct{})
+		for _, v := range e.Seen {
+			ps[v] = struct{}{}
+		}
+		s.prev[e.Key] = ps
+	}
+	s.counter = sf.Counter
+	return s, nil
+}
+
+// Save writes the state into file. The file is replaced only once the state
+// is completely written.
+func (s *State) Save(file string) error {
+	sf := stateFile{
+		Keys:    make([]stateEntry, 0, len(s.last)),
+		Counter: s.counter,
+	}
+	for k, p := range s.last {
+		// the packets that can not be decoded again by their family (eg: HRD
+		// packets not decoded from VMU records) are not saved.
+		f, bs := LookupPacket(p), packetRecord(p)
+		if f == nil || bs == nil {
+			continue
+		}
+		e := stateEntry{
+			Key:    k,
+			Family: f.Name,
+			Packet: bs,
+		}
+		if r := s.seen[k]; r != nil {
+			e.Seen = append(r.seen[r.next:len(r.seen):len(r.seen)], r.seen[:r.next]...)
+		}
+		sf.Keys = append(sf.Keys, e)
+	}
+	sort.Slice(sf.Keys, func(i, j int) bool { return sf.Keys[i].Key < sf.Keys[j].Key })
+	if c := sf.Counter; c != nil {
+		sortStateBuckets(c.Open)
+		sortStateBuckets(c.Last)
+	}
+	w, err := os.Create(file + ".tmp")
+	if err != nil {
+		return err
+	}
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+	if err := e.Encode(sf); err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return os.Rename(w.Name(), file)
+}
+
+func (s *State) Last(key string) Packet {
+	return s.last[key]
+}
+
+// Update records p as the last packet of key. p is only copied by detach,
+// before the file it was read from is released.
+func (s *State) Update(key string, p Packet) {
+	s.last[key] = p
+	delete(s.owned, key)
+	if !s.persist {
+		return
+	}
+	r := s.seen[key]
+	if r == nil {
+		r = &seenRing{}
+		s.seen[key] = r
+	}
+	r.add(seenPacket{When: p.Timestamp().UnixNano(), Sequence: p.Sequence()})
+}
+
+// detach copies the last packets not copied yet.
+func (s *State) detach() {
+	for k, p := range s.last {
+		if _, ok := s.owned[k]; ok {
+			continue
+		}
+		s.last[k], s.owned[k] = clonePacket(p), struct{}{}
+	}
+}
+
+// Skip reports whether p was already processed by the run that saved the
+// state.
+func (s *State) Skip(key string, p Packet) bool {
+	ps, ok := s.prev[key]
+	if !ok {
+		return false
+	}
+	_, ok = ps[seenPacket{When: p.Timestamp().UnixNano(), Sequence: p.Sequence()}]
+	return ok
+}
+
+func sortStateBuckets(bs []*stateBucket) {
+	sort.Slice(bs, func(i, j int) bool {
+		if bs[i].Key == bs[j].Key {
+			return bs[i].When.Before(bs[j].When)
+		}
+		return bs[i].Key < bs[j].Key
+	})
+}
+
+// recorder is implemented by the packets decoded from a larger record (eg:
+// the HRD packets carried by VMU packets).
+type recorder interface {
+	Record() []byte
+}
+
+func packetRecord(p Packet) []byte {
+	if r, ok := p.(recorder); ok {
+		return r.Record()
+	}
+	return p.Bytes()
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testMidnight is the time of the first packet of the runs: 90 minutes
+// before midnight.
+var testMidnight = time.Date(2026, 1, 1, 22, 30, 0, 0, time.UTC)
+
+type testRecord struct {
+	Index   int
+	Channel VMUChannel
+	Bytes   []byte
+}
+
+// testRecords gives one packet per minute and channel during three hours
+// with the missing sequences of each channel.
+func testRecords(t *testing.T, missing map[VMUChannel][]int) []testRecord {
+	t.Helper()
+	var (
+		rs     []testRecord
+		encode = EncodeVMU(0, 0, 0)
+	)
+	for i := 0; i <= 180; i++ {
+		for _, c := range []VMUChannel{ChannelVic1, ChannelVic2} {
+			var skip bool
+			for _, m := range missing[c] {
+				skip = skip || m == i
+			}
+			if skip {
+				continue
+			}
+			bs, err := encode(int(c), i, testMidnight.Add(time.Duration(i)*time.Minute), make([]byte, 32))
+			if err != nil {
+				t.Fatal(err)
+			}
+			rs = append(rs, testRecord{Index: i, Channel: c, Bytes: bs})
+		}
+	}
+	return rs
+}
+
+// writeRecords writes the records whose index is in [from, to) to file.
+func writeRecords(t *testing.T, file string, rs []testRecord, from, to int) string {
+	t.Helper()
+	w, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	for _, r := range rs {
+		if r.Index < from || r.Index >= to {
+			continue
+		}
+		if _, err := w.Write(r.Bytes); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return file
+}
+
+type testRun struct {
+	Gaps  []KeyGap
+	Cozes []KeyTimeCoze
+}
+
+// runState computes the gaps and the daily counts of file. The state is
+// loaded from and saved to state unless it is empty.
+func runState(t *testing.T, file, state string) testRun {
+	t.Helper()
+	var (
+		r   testRun
+		gs  = NewState()
+		cs  = NewState()
+		err error
+	)
+	if state != "" {
+		if gs, err = LoadState(state + ".gaps"); err != nil {
+			t.Fatal(err)
+		}
+		if cs, err = LoadState(state + ".count"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w := NewWalker(context.Background(), []string{file}, DecodeVMU())
+	w.State = gs
+	for g := range w.Gaps() {
+		r.Gaps = append(r.Gaps, *g)
+	}
+	if err := w.Err(); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	w = NewWalker(context.Background(), []string{file}, DecodeVMU())
+	w.State = cs
+	for k := range w.Count(NewCounter(Bucket{Width: Day})) {
+		k.Coze.run = 0
+		r.Cozes = append(r.Cozes, *k)
+	}
+	if err := w.Err(); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	if state != "" {
+		if err := gs.Save(state + ".gaps"); err != nil {
+			t.Fatal(err)
+		}
+		if err := cs.Save(state + ".count"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return r
+}
+
+func checkGaps(t *testing.T, what string, got, want []KeyGap) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Errorf("%s: got %d gaps, want %d", what, len(got), len(want))
+		return
+	}
+	for i := range got {
+		g, w := got[i], want[i]
+		if g.Key != w.Key || *g.Gap != *w.Gap {
+			t.Errorf("%s: gap %d: got %s %+v, want %s %+v", what, i, g.Key, *g.Gap, w.Key, *w.Gap)
+		}
+	}
+}
+
+func checkCozes(t *testing.T, what string, got, want []KeyTimeCoze) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Errorf("%s: got %d buckets, want %d", what, len(got), len(want))
+		return
+	}
+	for i := range got {
+		g, w := got[i], want[i]
+		if g.Key != w.Key || !g.When.Equal(w.When) || *g.Coze != *w.Coze {
+			t.Errorf("%s: bucket %d: got %s %s %+v, want %s %s %+v", what, i, g.Key, g.When, *g.Coze, w.Key, w.When, *w.Coze)
+		}
+	}
+}
+
+func TestStateAcrossMidnight(t *testing.T) {
+	var (
+		dir = t.TempDir()
+		rs  = testRecords(t, map[VMUChannel][]int{
+			// the second gap of vic1 starts before the packets given by both
+			// runs: only the last packet kept in the state reveals it
+			ChannelVic1: {40, 41, 42, 94, 95, 96, 97, 98, 99, 100, 101, 102},
+			ChannelVic2: {95, 96, 97},
+		})
+		all   = writeRecords(t, filepath.Join(dir, "all.dat"), rs, 0, 181)
+		first = writeRecords(t, filepath.Join(dir, "first.dat"), rs, 0, 100)
+		// the second run starts again a few minutes before the end of the first
+		second = writeRecords(t, filepath.Join(dir, "second.dat"), rs, 95, 181)
+		state  = filepath.Join(dir, "state")
+	)
+	want := runState(t, all, "")
+	if len(want.Gaps) != 3 {
+		t.Fatalf("got %d gaps in a single run, want 3", len(want.Gaps))
+	}
+	if len(want.Cozes) != 4 {
+		t.Fatalf("got %d buckets in a single run, want 4", len(want.Cozes))
+	}
+
+	// the buckets of the day before midnight are still open at the end of the
+	// first run: they are kept in the state and completed by the second one.
+	r1 := runState(t, first, state)
+	if len(r1.Cozes) != 0 {
+		t.Errorf("first run: got %d buckets, want the open buckets kept in the state", len(r1.Cozes))
+	}
+	r2 := runState(t, second, state)
+	checkGaps(t, "gaps", append(r1.Gaps, r2.Gaps...), want.Gaps)
+	checkCozes(t, "count", append(r1.Cozes, r2.Cozes...), want.Cozes[:2])
+
+	// the buckets after midnight are still open at the end of the second run
+	s, err := LoadState(state + ".count")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewCounter(Bucket{Width: Day})
+	c.State = s
+	c.restore()
+	c.State.persist = false
+	var open []KeyTimeCoze
+	for _, k := range c.Flush() {
+		k.Coze.run = 0
+		open = append(open, *k)
+	}
+	checkCozes(t, "state", open, want.Cozes[2:])
+
+	// without state, the packets of the second run given by the first one are
+	// counted twice and the gap spanning both runs is lost.
+	r1 = runState(t, first, "")
+	r2 = runState(t, second, "")
+	if n := len(r1.Gaps) + len(r2.Gaps); n == len(want.Gaps) {
+		t.Errorf("runs without state: got %d gaps, want a difference", n)
+	}
+	var count uint64
+	for _, k := range append(r1.Cozes, r2.Cozes...) {
+		count += k.Count
+	}
+	if count <= uint64(len(rs)) {
+		t.Errorf("runs without state: got %d packets, want more than %d", count, len(rs))
+	}
+}
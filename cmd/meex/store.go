@@ -84,16 +84,14 @@ func runStore(cmd *cli.Command, args []string) error {
 	if err := cmd.Flag.Parse(args); err != nil {
 		return err
 	}
-	var writeFunc func([]byte) ([]byte, error)
-	switch *kind {
-	case "tm", "pt", "pth":
-		writeFunc = storePTH
-	case "pp", "pdh", "pd":
-		writeFunc = storePDH
-	case "vmu":
-		writeFunc = storeVMU
-	}
-	w, err := NewBuffer(*datadir, *interval, writeFunc)
+	f, err := Lookup(*kind)
+	if err != nil {
+		return err
+	}
+	if f.Store == nil {
+		return fmt.Errorf("packet type %s can not be stored", f.Name)
+	}
+	w, err := NewBuffer(*datadir, *interval, f.Store)
 	if err != nil {
 		return err
 	}
@@ -160,6 +158,12 @@ func storePTH(bs []byte) ([]byte, error) {
 	return vs, nil
 }
 
+func storeRaw(bs []byte) ([]byte, error) {
+	vs := make([]byte, len(bs))
+	copy(vs, bs)
+	return vs, nil
+}
+
 func storePDH(bs []byte) ([]byte, error) {
 	vs := make([]byte, len(bs)+4)
 	binary.LittleEndian.PutUint32(vs, uint32(len(bs)))
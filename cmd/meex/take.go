@@ -1,36 +1,45 @@
 package main
 
 import (
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 
 	"github.com/midbel/cli"
 )
 
 var takeCommand = &cli.Command{
-	Usage: "take [-n parts] <source> <target>",
+	Usage: "take [-k type] [-w window] [-n parts] [-m mode] [-i interval] [-seed seed] <source> <target>",
 	Alias: []string{"split"},
-	Short: "splits randomly packets from source file to target file(s) into a new file",
+	Short: "splits packets from source file to target file(s)",
 	Run:   runTake,
 }
 
 var mixCommand = &cli.Command{
-	Usage: "mix [-s source] [-t target] [-u uniq] <file>",
+	Usage: "mix [-k type] [-w window] [-r ratio] [-seed seed] [-s source] [-t target] [-u uniq] <file>",
 	Alias: []string{"blend"},
 	Short: "take two rt files and mix their packets randomly into a new one",
 	Run:   runMix,
 }
 
 var shuffleCommand = &cli.Command{
-	Usage: "shuffle [-k type] <source> <target>",
+	Usage: "shuffle [-k type] [-w window] [-seed seed] <source> <target>",
 	Short: "shuffle packets from RT files",
 	Run:   runShuffle,
 }
 
 func runShuffle(cmd *cli.Command, args []string) error {
-	var kind Kind
+	var (
+		kind   Kind
+		window Window
+	)
 	cmd.Flag.Var(&kind, "k", "packet type")
+	cmd.Flag.Var(&window, "w", "duplicate window")
+	var seed Seed
+	cmd.Flag.Var(&seed, "seed", "random seed")
 	if err := cmd.Flag.Parse(args); err != nil {
 		return err
 	}
@@ -46,22 +55,35 @@ func runShuffle(cmd *cli.Command, args []string) error {
 	}
 	defer target.Close()
 
-	s, err := Shuffle(source, kind.Decod)
+	s, err := ShuffleWith(source, kind.Decod, seed.Rand())
 	if err != nil {
 		return err
 	}
 
-	_, err = io.CopyBuffer(NoDuplicate(target), s, make([]byte, MaxBufferSize))
+	_, err = io.CopyBuffer(window.Writer(target, kind.Decod), s, make([]byte, MaxBufferSize))
 	return err
 }
 
 func runMix(cmd *cli.Command, args []string) error {
+	var (
+		kind   Kind
+		window Window
+	)
+	cmd.Flag.Var(&kind, "k", "packet type")
+	cmd.Flag.Var(&window, "w", "duplicate window")
 	uniq := cmd.Flag.Bool("u", false, "no duplicate")
 	src := cmd.Flag.String("s", "", "source file")
 	dst := cmd.Flag.String("t", "", "target file")
+	ratio := cmd.Flag.String("r", "", "ratio")
+	var seed Seed
+	cmd.Flag.Var(&seed, "seed", "random seed")
 	if err := cmd.Flag.Parse(args); err != nil {
 		return err
 	}
+	weights, err := parseRatio(*ratio)
+	if err != nil {
+		return err
+	}
 	source, err := ScanFile(*src)
 	if err != nil {
 		return err
@@ -85,18 +107,51 @@ func runMix(cmd *cli.Command, args []string) error {
 	defer w.Close()
 
 	var ws io.Writer = w
-	if *uniq {
-		ws = NoDuplicate(ws)
+	if *uniq || window.IsSet() {
+		ws = window.Writer(ws, kind.Decod)
 	}
-	_, err = io.CopyBuffer(ws, MixReader(source, target), make([]byte, MaxBufferSize))
+	_, err = io.CopyBuffer(ws, MixReaderWith(seed.Rand(), weights, source, target), make([]byte, MaxBufferSize))
 	return err
 }
 
 func runTake(cmd *cli.Command, args []string) error {
+	var (
+		kind   Kind
+		window Window
+	)
+	cmd.Flag.Var(&kind, "k", "packet type")
+	cmd.Flag.Var(&window, "w", "duplicate window")
 	parts := cmd.Flag.Int("n", 2, "parts")
+	mode := cmd.Flag.String("m", "", "split mode")
+	interval := cmd.Flag.Duration("i", Five, "interval")
+	var seed Seed
+	cmd.Flag.Var(&seed, "seed", "random seed")
 	if err := cmd.Flag.Parse(args); err != nil {
 		return err
 	}
+	if err := checkParts(*parts); err != nil {
+		return err
+	}
+	var split SplitFunc
+	switch m := strings.ToLower(*mode); m {
+	case "", "random":
+		split = SplitRandom(*parts, seed.Rand())
+	case "round-robin", "rr":
+		split = SplitRoundRobin(*parts)
+	case "size":
+		split = SplitSize(*parts)
+	case "time", "id":
+		if kind.Decod == nil {
+			return fmt.Errorf("packet type required to split by %s", *mode)
+		}
+		if m == "time" {
+			split = SplitTime(*parts, kind.Decod, *interval)
+		} else {
+			split = SplitId(*parts, kind.Decod)
+		}
+	default:
+		return fmt.Errorf("unsupported split mode %s", *mode)
+	}
 
 	r, err := os.Open(cmd.Flag.Arg(0))
 	if err != nil {
@@ -109,13 +164,13 @@ func runTake(cmd *cli.Command, args []string) error {
 		file = filepath.Join(d, "meex.dat")
 	}
 
-	w, err := SplitWriter(file, *parts)
+	w, err := SplitWriterWith(file, *parts, split)
 	if err != nil {
 		return err
 	}
 	defer w.Close()
 
-	ws, s := NoDuplicate(w), Scan(r)
+	ws, s := window.Writer(w, kind.Decod), Scan(r)
 	for s.Scan() {
 		if _, err := ws.Write(s.Bytes()); err != nil {
 			return err
@@ -123,3 +178,18 @@ func runTake(cmd *cli.Command, args []string) error {
 	}
 	return s.Err()
 }
+
+func parseRatio(str string) ([]int, error) {
+	if str == "" {
+		return nil, nil
+	}
+	var ws []int
+	for _, s := range strings.Split(str, ":") {
+		w, err := strconv.Atoi(s)
+		if err != nil || w <= 0 {
+			return nil, fmt.Errorf("invalid ratio %s", str)
+		}
+		ws = append(ws, w)
+	}
+	return ws, nil
+}
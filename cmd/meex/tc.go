@@ -0,0 +1,454 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/adler32"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/busoc/timutil"
+	"github.com/midbel/cli"
+	"github.com/midbel/linewriter"
+	"github.com/midbel/xxh"
+)
+
+const (
+	TCHeaderLen = 12
+	TCType      = 0x0A
+)
+
+var correlateCommand = &cli.Command{
+	Usage: "correlate [-k type] [-w window] [-a all] [-j jobs] <commands> <telemetry...>",
+	Alias: []string{"ack"},
+	Short: "match telecommands with their acknowledgement and response packets",
+	Run:   runCorrelate,
+}
+
+type TCHeader struct {
+	Size   uint32
+	Type   uint8
+	Uplink time.Time
+	Status uint8
+	Origin uint8
+}
+
+func (t *TCHeader) UnmarshalBinary(bs []byte) error {
+	if len(bs) < TCHeaderLen {
+		return ErrShortBuffer
+	}
+	t.Size = binary.LittleEndian.Uint32(bs)
+	t.Type = bs[4]
+	t.Uplink = timutil.Join5(binary.BigEndian.Uint32(bs[5:]), bs[9])
+	t.Status = bs[10]
+	t.Origin = bs[11]
+
+	return nil
+}
+
+func (t *TCHeader) MarshalBinary() ([]byte, error) {
+	var w bytes.Buffer
+	coarse, fine := timutil.Split5(t.Uplink)
+
+	binary.Write(&w, binary.LittleEndian, t.Size)
+	binary.Write(&w, binary.LittleEndian, t.Type)
+	binary.Write(&w, binary.BigEndian, coarse)
+	binary.Write(&w, binary.BigEndian, fine)
+	binary.Write(&w, binary.BigEndian, t.Status)
+	binary.Write(&w, binary.BigEndian, t.Origin)
+
+	return w.Bytes(), nil
+}
+
+type TCPacket struct {
+	TCH     *TCHeader
+	CCSDS   *CCSDSHeader
+	ESA     *ESAHeader
+	PUS     *PUSHeader
+	Payload []byte
+}
+
+func DecodeTC() Decoder {
+	return DecodeTCWith(TMOptions{})
+}
+
+func DecodeTCWith(o TMOptions) Decoder {
+	f := func(bs []byte) (Packet, error) {
+		if len(bs) < TCHeaderLen+CCSDSHeaderLen {
+			return nil, ErrShortBuffer
+		}
+		var (
+			h TCHeader
+			c CCSDSHeader
+		)
+		if err := h.UnmarshalBinary(bs); err != nil {
+			return nil, err
+		}
+		if err := c.UnmarshalBinary(bs[TCHeaderLen:]); err != nil {
+			return nil, err
+		}
+		t := TCPacket{
+			TCH:     &h,
+			CCSDS:   &c,
+			Payload: bs,
+		}
+		if c.HasSecondary() {
+			var e ESAHeader
+			if err := e.UnmarshalBinary(bs[TCHeaderLen+CCSDSHeaderLen:]); err != nil {
+				return nil, err
+			}
+			t.ESA = &e
+			t.PUS = o.decodePUS(c.Apid(), bs[TCHeaderLen+CCSDSHeaderLen+ESAHeaderLen:])
+		}
+		return &t, nil
+	}
+	return DecoderFunc(f)
+}
+
+func EncodeTC() EncoderFunc {
+	return func(id, seq int, when time.Time, payload []byte) ([]byte, error) {
+		size := TCHeaderLen + CCSDSHeaderLen + ESAHeaderLen + len(payload)
+		h := TCHeader{
+			Size:   uint32(size - 4),
+			Type:   TCType,
+			Uplink: when,
+		}
+		c := CCSDSHeader{
+			Version:  0x1800 | uint16(id&0x07FF),
+			Fragment: 0xC000 | uint16(seq&0x3FFF),
+			Length:   uint16(ESAHeaderLen + len(payload) - 1),
+		}
+		e := ESAHeader{
+			Acquisition: when,
+			Info:        uint8(PayloadCmd),
+			Source:      uint32(seq),
+		}
+		bs := make([]byte, 0, size)
+		for _, m := range []interface{ MarshalBinary() ([]byte, error) }{&h, &c, &e} {
+			vs, err := m.MarshalBinary()
+			if err != nil {
+				return nil, err
+			}
+			bs = append(bs, vs...)
+		}
+		return append(bs, payload...), nil
+	}
+}
+
+func isTC(bs []byte) bool {
+	if len(bs) < TCHeaderLen+CCSDSHeaderLen || bs[4] != TCType {
+		return false
+	}
+	if bs[TCHeaderLen]>>5 != 0 || bs[TCHeaderLen]&0x10 == 0 {
+		return false
+	}
+	size := binary.BigEndian.Uint16(bs[TCHeaderLen+4:])
+	return int(size)+1+CCSDSHeaderLen == len(bs)-TCHeaderLen
+}
+
+func storeTC(bs []byte) ([]byte, error) {
+	h := TCHeader{
+		Size:   uint32(len(bs) + TCHeaderLen - 4),
+		Type:   TCType,
+		Uplink: time.Now(),
+	}
+	vs, err := h.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return append(vs, bs...), nil
+}
+
+func (t *TCPacket) Error() bool {
+	if t.TCH.Status != 0 {
+		return true
+	}
+	c := t.CCSDS
+	return c.Size() != len(t.Payload)-TCHeaderLen || c.VersionNumber() != 0 || c.Type() != 1
+}
+
+func (t *TCPacket) PacketInfo() *Info {
+	service, subtype := t.Service()
+	return &Info{
+		Id:       t.CCSDS.Apid(),
+		Sequence: t.Sequence(),
+		Size:     len(t.Payload) - TCHeaderLen,
+		AcqTime:  t.Timestamp(),
+		Sum:      adler32.Checksum(t.Payload[TCHeaderLen:]),
+		Context:  t.PacketType().String(),
+		Type:     "tc",
+		Service:  service,
+		Subtype:  subtype,
+		Source:   t.Source(),
+	}
+}
+
+func (t *TCPacket) Service() (int, int) {
+	if t.PUS == nil {
+		return 0, 0
+	}
+	return int(t.PUS.Service), int(t.PUS.Subtype)
+}
+
+func (t *TCPacket) Source() int {
+	if t.ESA == nil {
+		return 0
+	}
+	return int(t.ESA.Source)
+}
+
+func (t *TCPacket) PacketType() ESAPacketType {
+	if t.ESA == nil {
+		return Default
+	}
+	return t.ESA.PacketType()
+}
+
+func (t *TCPacket) Timestamp() time.Time {
+	return t.TCH.Uplink
+}
+
+func (t *TCPacket) Reception() time.Time {
+	return t.TCH.Uplink
+}
+
+func (t *TCPacket) Id() (int, int) {
+	return t.CCSDS.Apid(), t.Source()
+}
+
+func (t *TCPacket) Sequence() int {
+	return t.CCSDS.Sequence()
+}
+
+func (t *TCPacket) Len() int {
+	return len(t.Payload)
+}
+
+func (t *TCPacket) Less(p Packet) bool {
+	return t.Sequence() < p.Sequence()
+}
+
+func (t *TCPacket) Diff(o Packet) *Gap {
+	if p, ok := o.(*TCPacket); o == nil || !ok || t.CCSDS.Apid() != p.CCSDS.Apid() {
+		return nil
+	}
+	if o.Timestamp().After(t.Timestamp()) {
+		return o.Diff(t)
+	}
+	if delta := (t.Sequence() - o.Sequence()) & 0x3FFF; delta <= 1 {
+		return nil
+	}
+	return &Gap{
+		Id:     t.CCSDS.Apid(),
+		Starts: o.Timestamp(),
+		Ends:   t.Timestamp(),
+		First:  t.Sequence(),
+		Last:   o.Sequence(),
+	}
+}
+
+func (t *TCPacket) Bytes() []byte {
+	return t.Payload
+}
+
+func printTCPacket(line *linewriter.Writer, p *TCPacket, g *Gap, delta time.Duration) {
+	var diff int
+	if g != nil {
+		diff = g.Missing()
+	}
+	service := "-"
+	if p.PUS != nil {
+		service = p.PUS.String()
+	}
+	line.AppendUint(uint64(p.Sequence()), 9, linewriter.AlignRight)
+	line.AppendUint(uint64(diff), 4, linewriter.AlignRight)
+	line.AppendUint(uint64(p.Len()), 4, linewriter.AlignRight)
+	line.AppendUint(uint64(p.CCSDS.Apid()), 4, linewriter.AlignRight)
+	line.AppendTime(p.Timestamp().Add(delta), TimeFormat, linewriter.AlignRight)
+	line.AppendString(p.PacketType().String(), 16, linewriter.AlignRight)
+	line.AppendString(service, 7, linewriter.AlignRight)
+	line.AppendUint(uint64(p.Source()), 8, linewriter.AlignRight|linewriter.WithZero|linewriter.Hex)
+	line.AppendUint(uint64(p.TCH.Status), 2, linewriter.AlignRight|linewriter.WithZero|linewriter.Hex)
+	line.AppendUint(xxh.Sum64(p.Bytes(), 0), 8, linewriter.AlignRight|linewriter.WithZero|linewriter.Hex)
+
+	io.Copy(os.Stdout, line)
+}
+
+type Verification int
+
+const (
+	NoVerification Verification = iota
+	Accepted
+	Completed
+	Failed
+)
+
+func (v Verification) String() string {
+	switch v {
+	case Accepted:
+		return "ack"
+	case Completed:
+		return "response"
+	case Failed:
+		return "failed"
+	default:
+		return "-"
+	}
+}
+
+// Verify classifies a TM packet as an acknowledgement, a response or a
+// failure report from its ESA packet type or from its PUS service 1 subtype.
+func Verify(t *TMPacket) Verification {
+	switch t.PacketType() {
+	case Acknowledge:
+		return Accepted
+	case Response:
+		return Completed
+	case Exception:
+		return Failed
+	}
+	if t.PUS == nil || t.PUS.Service != 1 {
+		return NoVerification
+	}
+	switch {
+	case t.PUS.Subtype%2 == 0:
+		return Failed
+	case t.PUS.Subtype == 7:
+		return Completed
+	default:
+		return Accepted
+	}
+}
+
+type Correlation struct {
+	Command  *TCPacket
+	Ack      *TMPacket
+	Response *TMPacket
+	Failure  *TMPacket
+}
+
+func (c *Correlation) Status() string {
+	switch {
+	case c.Failure != nil:
+		return "failed"
+	case c.Response != nil:
+		return "completed"
+	case c.Ack != nil:
+		return "accepted"
+	default:
+		return "missing"
+	}
+}
+
+func Correlate(cs []*TCPacket, ts []*TMPacket, window time.Duration) []*Correlation {
+	sources := make(map[int][]*TMPacket)
+	for _, t := range ts {
+		sources[t.Source()] = append(sources[t.Source()], t)
+	}
+	for _, vs := range sources {
+		sort.Slice(vs, func(i, j int) bool { return vs[i].Timestamp().Before(vs[j].Timestamp()) })
+	}
+	sort.Slice(cs, func(i, j int) bool { return cs[i].Timestamp().Before(cs[j].Timestamp()) })
+
+	var (
+		rs   = make([]*Correlation, 0, len(cs))
+		used = make(map[*TMPacket]struct{})
+	)
+	for _, c := range cs {
+		r := Correlation{Command: c}
+		vs := sources[c.Source()]
+		ix := sort.Search(len(vs), func(i int) bool { return !vs[i].Timestamp().Before(c.Timestamp()) })
+		for _, t := range vs[ix:] {
+			if window > 0 && t.Timestamp().Sub(c.Timestamp()) > window {
+				break
+			}
+			if _, ok := used[t]; ok {
+				continue
+			}
+			switch v := Verify(t); {
+			case v == Accepted && r.Ack == nil:
+				r.Ack = t
+			case v == Completed && r.Response == nil:
+				r.Response = t
+			case v == Failed && r.Failure == nil:
+				r.Failure = t
+			default:
+				continue
+			}
+			used[t] = struct{}{}
+		}
+		rs = append(rs, &r)
+	}
+	return rs
+}
+
+func runCorrelate(cmd *cli.Command, args []string) error {
+	var kind Kind
+	cmd.Flag.Var(&kind, "k", "telemetry packet type")
+	window := cmd.Flag.Duration("w", time.Minute, "maximum delay between command and verification")
+	all := cmd.Flag.Bool("a", false, "show all commands")
+	jobs := cmd.Flag.Int("j", 1, "parallel jobs")
+	if err := cmd.Flag.Parse(args); err != nil {
+		return err
+	}
+	if cmd.Flag.NArg() < 2 {
+		return fmt.Errorf("commands and telemetry files expected")
+	}
+	if kind.Decod == nil {
+		kind.Set("tm:pus")
+	}
+	ctx, cancel := Interrupt()
+	defer cancel()
+
+	var (
+		cs []*TCPacket
+		ts []*TMPacket
+	)
+	commands := NewWalker(ctx, cmd.Flag.Args()[:1], DecodeTC())
+	defer commands.Close()
+	commands.Jobs = *jobs
+	for p := range commands.Walk() {
+		if c, ok := p.(*TCPacket); ok {
+			cs = append(cs, clonePacket(c).(*TCPacket))
+		}
+	}
+	if err := commands.Err(); err != nil {
+		return err
+	}
+	telemetry := NewWalker(ctx, cmd.Flag.Args()[1:], kind.Decod)
+	defer telemetry.Close()
+	telemetry.Jobs = *jobs
+	for p := range telemetry.Walk() {
+		if t, ok := p.(*TMPacket); ok && Verify(t) != NoVerification {
+			ts = append(ts, clonePacket(t).(*TMPacket))
+		}
+	}
+	if err := telemetry.Err(); err != nil {
+		return err
+	}
+
+	const row = "%6d | %4d | %08x | %s | %10s | %10s | %s"
+	counts := make(map[string]int)
+	for _, r := range Correlate(cs, ts, *window) {
+		status := r.Status()
+		counts[status]++
+		if !*all && status == "completed" {
+			continue
+		}
+		c := r.Command
+		log.Printf(row, c.Sequence(), c.CCSDS.Apid(), c.Source(), c.Timestamp().Format(TimeFormat), delay(c, r.Ack), delay(c, r.Response), status)
+	}
+	log.Printf("%d commands: %d completed, %d accepted, %d failed, %d missing", len(cs), counts["completed"], counts["accepted"], counts["failed"], counts["missing"])
+	return nil
+}
+
+func delay(c *TCPacket, t *TMPacket) string {
+	if t == nil {
+		return "-"
+	}
+	return t.Timestamp().Sub(c.Timestamp()).String()
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/midbel/cli"
+)
+
+var upiCommand = &cli.Command{
+	Usage: "upi [-a archive] [-f from] [-t to] [-p patterns] [-m mode] [-d datadir] [-g gps-time] [-j jobs] [file...]",
+	Short: "catalog the UPIs of VMU packets and extract them by UPI",
+	Run:   runUPI,
+}
+
+// UPIEntry gathers the packets of an UPI. Raw is the UPI as found in the
+// packets, UPI its printable form.
+type UPIEntry struct {
+	Raw     string
+	UPI     string
+	First   time.Time
+	Last    time.Time
+	Packets int
+	Images  int
+	Errors  int
+	Origins map[uint8]int
+}
+
+func (u *UPIEntry) Update(v *VMUPacket, h *VMUCommonHeader) {
+	when := h.Acquisition()
+	if u.Packets == 0 || when.Before(u.First) {
+		u.First = when
+	}
+	if u.Packets == 0 || when.After(u.Last) {
+		u.Last = when
+	}
+	u.Packets++
+	if v.VMU.Channel == ChannelVic1 || v.VMU.Channel == ChannelVic2 {
+		u.Images++
+	}
+	if v.Error() {
+		u.Errors++
+	}
+	u.Origins[h.Origin]++
+}
+
+func (u *UPIEntry) OriginList() string {
+	ns := make([]int, 0, len(u.Origins))
+	for o := range u.Origins {
+		ns = append(ns, int(o))
+	}
+	sort.Ints(ns)
+	vs := make([]string, len(ns))
+	for i, o := range ns {
+		vs[i] = fmt.Sprintf("%02x", o)
+	}
+	return strings.Join(vs, ",")
+}
+
+func matchUPI(patterns []string, upi string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, upi); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// upiFile returns a file name for upi: the characters masked by
+// VMUCommonHeader.String are replaced by underscores and a suffix is added
+// when the name is already used by another UPI.
+func upiFile(dir, upi string, used map[string]struct{}) string {
+	name := strings.Replace(upi, "*", "_", -1)
+	for i := 1; ; i++ {
+		if _, ok := used[name]; !ok {
+			break
+		}
+		name = fmt.Sprintf("%s-%d", strings.Replace(upi, "*", "_", -1), i)
+	}
+	used[name] = struct{}{}
+	return filepath.Join(dir, name+".dat")
+}
+
+// MaxUPIFiles is the number of files kept open while extracting the packets
+// of each UPI. The least recently written file is closed when a new one has to
+// be opened and reopened in append mode when its UPI comes back.
+const MaxUPIFiles = 64
+
+type upiWriter struct {
+	key  string
+	file *os.File
+}
+
+type upiWriters struct {
+	dir   string
+	limit int
+	files map[string]string
+	open  map[string]*list.Element
+	lru   *list.List
+	used  map[string]struct{}
+}
+
+func newUPIWriters(dir string, limit int) *upiWriters {
+	return &upiWriters{
+		dir:   dir,
+		limit: limit,
+		files: make(map[string]string),
+		open:  make(map[string]*list.Element),
+		lru:   list.New(),
+		used:  make(map[string]struct{}),
+	}
+}
+
+func (u *upiWriters) Write(key, upi string, bs []byte) error {
+	e, ok := u.open[key]
+	if ok {
+		u.lru.MoveToFront(e)
+	} else {
+		if u.lru.Len() >= u.limit {
+			if err := u.evict(); err != nil {
+				return err
+			}
+		}
+		f, err := u.openFile(key, upi)
+		if err != nil {
+			return err
+		}
+		e = u.lru.PushFront(&upiWriter{key: key, file: f})
+		u.open[key] = e
+	}
+	_, err := e.Value.(*upiWriter).file.Write(bs)
+	return err
+}
+
+func (u *upiWriters) openFile(key, upi string) (*os.File, error) {
+	if file, ok := u.files[key]; ok {
+		return os.OpenFile(file, os.O_WRONLY|os.O_APPEND, 0644)
+	}
+	file := upiFile(u.dir, upi, u.used)
+	f, err := os.Create(file)
+	if err == nil {
+		u.files[key] = file
+	}
+	return f, err
+}
+
+func (u *upiWriters) evict() error {
+	e := u.lru.Back()
+	w := u.lru.Remove(e).(*upiWriter)
+	delete(u.open, w.key)
+	return w.file.Close()
+}
+
+func (u *upiWriters) Close() error {
+	var err error
+	for u.lru.Len() > 0 {
+		if e := u.evict(); err == nil && e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func runUPI(cmd *cli.Command, args []string) error {
+	archive := cmd.Flag.String("a", "", "archive directory")
+	from := cmd.Flag.String("f", "", "start time")
+	to := cmd.Flag.String("t", "", "end time")
+	names := cmd.Flag.String("p", "", "UPI patterns")
+	mode := cmd.Flag.String("m", "", "realtime or playback packets only")
+	datadir := cmd.Flag.String("d", "", "extract into directory")
+	toGPS := cmd.Flag.Bool("g", false, "gps time")
+	jobs := cmd.Flag.Int("j", 1, "parallel jobs")
+	if err := cmd.Flag.Parse(args); err != nil {
+		return err
+	}
+	paths, fd, td, err := archivePaths(cmd.Flag.Args(), *archive, *from, *to)
+	if err != nil {
+		return err
+	}
+	decoder := DecodeVMU()
+	if *mode != "" {
+		m, err := parseMode(*mode)
+		if err != nil {
+			return err
+		}
+		decoder = DecodeVMUMode(m)
+	}
+	var patterns []string
+	for _, n := range strings.Split(*names, ",") {
+		if n = strings.TrimSpace(n); n != "" {
+			patterns = append(patterns, n)
+		}
+	}
+	if *datadir != "" {
+		if err := os.MkdirAll(*datadir, 0755); err != nil && !os.IsExist(err) {
+			return err
+		}
+	}
+	var delta time.Duration
+	if *toGPS {
+		delta = -GPS.Sub(UNIX)
+	}
+
+	ctx, cancel := Interrupt()
+	defer cancel()
+
+	es := make(map[string]*UPIEntry)
+	ws := newUPIWriters(*datadir, MaxUPIFiles)
+	defer ws.Close()
+
+	walker := NewWalker(ctx, paths, decoder)
+	defer walker.Close()
+	walker.Jobs = *jobs
+	for p := range walker.Walk() {
+		v, ok := p.(*VMUPacket)
+		if !ok {
+			continue
+		}
+		when := v.Timestamp()
+		if (!fd.IsZero() && when.Before(fd)) || (!td.IsZero() && !when.Before(td)) {
+			continue
+		}
+		h := v.Common()
+		if h == nil {
+			continue
+		}
+		raw, upi := h.RawUPI(), h.String()
+		if !matchUPI(patterns, raw) && !matchUPI(patterns, upi) {
+			continue
+		}
+		key := raw
+		if key == "" {
+			// packets without UPI are gathered by type
+			key = "\x00" + upi
+		}
+		e, ok := es[key]
+		if !ok {
+			e = &UPIEntry{Raw: raw, UPI: upi, Origins: make(map[uint8]int)}
+			es[key] = e
+		}
+		e.Update(v, h)
+
+		if *datadir == "" {
+			continue
+		}
+		if err := ws.Write(key, upi, v.Bytes()); err != nil {
+			return err
+		}
+	}
+	if err := walker.Err(); err != nil {
+		return err
+	}
+	if err := ws.Close(); err != nil {
+		return err
+	}
+
+	vs := make([]*UPIEntry, 0, len(es))
+	for _, e := range es {
+		vs = append(vs, e)
+	}
+	sort.Slice(vs, func(i, j int) bool {
+		if vs[i].UPI != vs[j].UPI {
+			return vs[i].UPI < vs[j].UPI
+		}
+		return vs[i].Raw < vs[j].Raw
+	})
+
+	const row = "%-32s | %s | %s | %8d | %8d | %8d | %s"
+	for _, e := range vs {
+		f, l := e.First.Add(delta).Format(TimeFormat), e.Last.Add(delta).Format(TimeFormat)
+		upi := e.UPI
+		if e.Raw != "" && e.Raw != e.UPI {
+			upi = strconv.Quote(e.Raw)
+		}
+		log.Printf(row, upi, f, l, e.Packets, e.Images, e.Errors, e.OriginList())
+	}
+	log.Printf("%d UPIs found", len(vs))
+	return nil
+}
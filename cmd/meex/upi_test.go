@@ -0,0 +1,52 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestUPIWriters(t *testing.T) {
+	dir := t.TempDir()
+	ws := newUPIWriters(dir, 2)
+	for _, w := range []struct {
+		Key  string
+		UPI  string
+		Data string
+	}{
+		{Key: "a", UPI: "A", Data: "a1"},
+		{Key: "b", UPI: "B*", Data: "b1"},
+		{Key: "a", UPI: "A", Data: "a2"},
+		// closes b, the least recently written
+		{Key: "c", UPI: "C", Data: "c1"},
+		// reopens b and closes a
+		{Key: "b", UPI: "B*", Data: "b2"},
+		{Key: "a", UPI: "A", Data: "a3"},
+		{Key: "d", UPI: "A", Data: "d1"},
+	} {
+		if err := ws.Write(w.Key, w.UPI, []byte(w.Data)); err != nil {
+			t.Fatalf("%s: %s", w.Key, err)
+		}
+		if n := ws.lru.Len(); n > 2 {
+			t.Fatalf("%d files open", n)
+		}
+	}
+	if err := ws.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for f, want := range map[string]string{
+		"A.dat":   "a1a2a3",
+		"B_.dat":  "b1b2",
+		"C.dat":   "c1",
+		"A-1.dat": "d1",
+	} {
+		bs, err := ioutil.ReadFile(filepath.Join(dir, f))
+		if err != nil {
+			t.Errorf("%s: %s", f, err)
+			continue
+		}
+		if string(bs) != want {
+			t.Errorf("%s: got %q, want %q", f, bs, want)
+		}
+	}
+}
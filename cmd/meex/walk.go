@@ -1,10 +1,17 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"sort"
+	"sync"
+	"syscall"
 	"time"
 )
 
@@ -44,24 +51,429 @@ func timePath(dir string, t time.Time) string {
 	return filepath.Join(dir, year, doy, hour)
 }
 
+type Walker struct {
+	Jobs  int
+	Key   func(Packet) string
+	State *State
+
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	paths   []string
+	decoder Decoder
+	demux   *Demux
+
+	mu     sync.Mutex
+	errors []*PacketError
+	files  int
+	maps   []*MappedReader
+}
+
+// NewWalker creates a walker decoding the packets of paths with d. Without d,
+// the packet type of each file is detected (see DecodeAuto).
+func NewWalker(ctx context.Context, paths []string, d Decoder) *Walker {
+	if d == nil {
+		d = DecodeAuto()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	return &Walker{
+		ctx:     ctx,
+		cancel:  cancel,
+		paths:   paths,
+		decoder: d,
+	}
+}
+
+// run runs f in a goroutine that Close waits for.
+func (w *Walker) run(f func()) {
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		f()
+	}()
+}
+
 func Walk(paths []string, d Decoder) <-chan Packet {
+	return NewWalker(context.Background(), paths, d).Walk()
+}
+
+// Walk gives the packets of the walker. A mapped file is released once the
+// packets of the files after it are received: the packets kept longer than
+// that must be copied (see clonePacket).
+func (w *Walker) Walk() <-chan Packet {
 	q := make(chan Packet)
-	go func() {
+	w.run(func() {
 		defer close(q)
-		if d == nil {
+
+		var done []*MappedReader
+		send := func(p Packet) error {
+			select {
+			case q <- p:
+			case <-w.ctx.Done():
+				return w.ctx.Err()
+			}
+			// the packets given before p are consumed
+			for _, m := range done {
+				w.unmap(m)
+			}
+			done = done[:0]
+			return nil
+		}
+		w.each(send, func(m *MappedReader) { done = append(done, m) })
+	})
+	return q
+}
+
+// apply calls fn with the packets of the walker in the calling goroutine. A
+// mapped file is released as soon as all its packets are given to fn, after
+// keep is called to copy the packets fn retains.
+func (w *Walker) apply(fn func(Packet) error, keep func()) {
+	send := func(p Packet) error {
+		if err := w.ctx.Err(); err != nil {
+			return err
+		}
+		return fn(p)
+	}
+	w.each(send, func(m *MappedReader) {
+		keep()
+		w.unmap(m)
+	})
+}
+
+// each gives the packets of the walker to send. release is called with each
+// mapped file once all its packets are given.
+func (w *Walker) each(send func(Packet) error, release func(*MappedReader)) {
+	w.demux = demuxOf(w.decoder)
+	sort.Strings(w.paths)
+	if w.Jobs > 1 {
+		w.walkParallel(send, release)
+		return
+	}
+	for _, p := range w.paths {
+		if p == "" {
+			continue
+		}
+		if err := w.walk(p, send, release); err != nil {
 			return
 		}
-		sort.Strings(paths)
-		for _, p := range paths {
+	}
+}
+
+// walkBuffer is the number of packets (or frames) a parallel job decodes
+// ahead of the packets of its file being emitted.
+const walkBuffer = 256
+
+type walkResult struct {
+	file   string
+	items  chan walkItem
+	mapped *MappedReader
+}
+
+type walkItem struct {
+	pos    int64
+	packet Packet
+	frame  []byte
+	err    *PacketError
+}
+
+func (w *Walker) walkParallel(send func(Packet) error, release func(*MappedReader)) {
+	files := make(chan string)
+	w.run(func() {
+		defer close(files)
+		for _, p := range w.paths {
 			if p == "" {
 				continue
 			}
-			if err := walk(p, q, d); err != nil {
+			err := filepath.Walk(p, func(p string, i os.FileInfo, err error) error {
+				if err == nil && i.IsDir() {
+					return nil
+				}
+				select {
+				case files <- p:
+				case <-w.ctx.Done():
+					return w.ctx.Err()
+				}
+				return nil
+			})
+			if err != nil {
 				return
 			}
 		}
-	}()
-	return q
+	})
+
+	results := make(chan *walkResult, w.Jobs)
+	w.run(func() {
+		defer close(results)
+		sema := make(chan struct{}, w.Jobs)
+		for f := range files {
+			r := &walkResult{
+				file:  f,
+				items: make(chan walkItem, walkBuffer),
+			}
+			select {
+			case results <- r:
+			case <-w.ctx.Done():
+				return
+			}
+			select {
+			case sema <- struct{}{}:
+			case <-w.ctx.Done():
+				return
+			}
+			w.run(func() {
+				defer func() { <-sema }()
+				w.readFile(r)
+			})
+		}
+	})
+
+	for r := range results {
+		w.files++
+		var (
+			pos  int64
+			read = func() (int64, []byte, error) {
+				for it := range r.items {
+					if it.err != nil {
+						w.report(it.err)
+						continue
+					}
+					pos = it.pos
+					return it.pos, it.frame, nil
+				}
+				return pos, nil, io.EOF
+			}
+			next func() (Packet, error)
+		)
+		if w.demux != nil {
+			// frames are demultiplexed in the order of the files
+			dec := decoderOf(w.decoder)
+			next = func() (Packet, error) {
+				return w.demux.next(read, dec)
+			}
+		} else {
+			next = func() (Packet, error) {
+				it, ok := <-r.items
+				switch {
+				case !ok:
+					return nil, io.EOF
+				case it.err != nil:
+					return nil, it.err
+				}
+				pos = it.pos
+				return it.packet, nil
+			}
+		}
+		if err := w.emit(r.file, next, func() int64 { return pos }, send); err != nil {
+			return
+		}
+		// the items of r are all received so r.mapped is set if any
+		if r.mapped != nil {
+			release(r.mapped)
+		}
+	}
+}
+
+// readFile decodes the packets (or reads the frames) of the file of r. It
+// stops as soon as the walk is cancelled.
+func (w *Walker) readFile(r *walkResult) {
+	defer close(r.items)
+
+	send := func(it walkItem) bool {
+		select {
+		case r.items <- it:
+			return true
+		case <-w.ctx.Done():
+			return false
+		}
+	}
+	rs, err := w.mapFile(r.file)
+	if err == nil {
+		r.mapped = rs
+	} else {
+		bs, err := ioutil.ReadFile(r.file)
+		if err != nil {
+			send(walkItem{err: &PacketError{File: r.file, Err: err}})
+			return
+		}
+		rs = NewBytesReader(bs, w.decoder)
+	}
+	if w.demux != nil {
+		for {
+			pos, bs, err := rs.read()
+			if err != nil {
+				if e, ok := err.(*PacketError); ok {
+					e.File = r.file
+					send(walkItem{err: e})
+				}
+				return
+			}
+			if !send(walkItem{pos: pos, frame: bs}) {
+				return
+			}
+		}
+	}
+	for {
+		pos := int64(rs.offset)
+		p, err := rs.Next()
+		if err == nil {
+			if !send(walkItem{pos: pos, packet: p}) {
+				return
+			}
+			continue
+		}
+		if err == ErrSkip {
+			continue
+		}
+		e, ok := err.(*PacketError)
+		if !ok {
+			return
+		}
+		e.File = r.file
+		if !send(walkItem{err: e}) || !e.Corrupted {
+			return
+		}
+	}
+}
+
+func (w *Walker) Errors() []*PacketError {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.errors
+}
+
+func (w *Walker) Err() error {
+	if err := w.ctx.Err(); err != nil {
+		return err
+	}
+	es := w.Errors()
+	if len(es) == 0 {
+		return nil
+	}
+	files := make(map[string]struct{})
+	for _, e := range es {
+		log.Printf("error: %s", e)
+		if !e.Corrupted {
+			files[e.File] = struct{}{}
+		}
+	}
+	return fmt.Errorf("%d errors found (%d unreadable files out of %d)", len(es), len(files), w.files)
+}
+
+func (w *Walker) report(e *PacketError) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.errors = append(w.errors, e)
+}
+
+func (w *Walker) walk(p string, send func(Packet) error, release func(*MappedReader)) error {
+	var rt *Reader
+	return filepath.Walk(p, func(p string, i os.FileInfo, err error) error {
+		if err := w.ctx.Err(); err != nil {
+			return err
+		}
+		if err != nil {
+			w.files++
+			w.report(&PacketError{File: p, Err: err})
+			return nil
+		}
+		if i.IsDir() {
+			return nil
+		}
+		w.files++
+		if i.Mode().IsRegular() {
+			if m, err := w.mapFile(p); err == nil {
+				m.demux = w.demux
+				err := w.emit(p, m.Next, func() int64 { return int64(m.offset) }, send)
+				release(m)
+				return err
+			}
+		}
+		r, err := os.Open(p)
+		if err != nil {
+			w.report(&PacketError{File: p, Err: err})
+			return nil
+		}
+		defer r.Close()
+
+		if rt == nil {
+			rt = NewReader(r, w.decoder)
+			rt.demux = w.demux
+		} else {
+			rt.Reset(r)
+		}
+		return w.emit(p, rt.Next, func() int64 { return rt.pos }, send)
+	})
+}
+
+func (w *Walker) emit(file string, next func() (Packet, error), pos func() int64, send func(Packet) error) error {
+	for {
+		p, err := next()
+		switch e := err.(type) {
+		case nil:
+			if err := send(p); err != nil {
+				return err
+			}
+			continue
+		case *PacketError:
+			e.File = file
+			w.report(e)
+			if e.Corrupted {
+				continue
+			}
+			return nil
+		}
+		if err == ErrSkip {
+			continue
+		}
+		if err != io.EOF {
+			w.report(&PacketError{File: file, Offset: pos(), Err: err})
+		}
+		return nil
+	}
+}
+
+// mapFile maps file in memory. The packets decoded from it point into the
+// mapping, so it is released by unmap once they are consumed or by Close.
+func (w *Walker) mapFile(file string) (*MappedReader, error) {
+	m, err := MapFile(file, w.decoder)
+	if err != nil {
+		return nil, err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.maps = append(w.maps, m)
+	return m, nil
+}
+
+func (w *Walker) unmap(m *MappedReader) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for i := range w.maps {
+		if w.maps[i] == m {
+			w.maps = append(w.maps[:i], w.maps[i+1:]...)
+			break
+		}
+	}
+	m.Close()
+}
+
+// Close stops the walk and releases the files mapped by the walker once all
+// its goroutines are done. The packets it gave are no longer valid once it is
+// called.
+func (w *Walker) Close() error {
+	w.cancel()
+	w.wg.Wait()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var err error
+	for _, m := range w.maps {
+		if e := m.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	w.maps = w.maps[:0]
+	return err
 }
 
 type KeyGap struct {
@@ -69,24 +481,35 @@ type KeyGap struct {
 	Key string
 }
 
-func Gaps(paths []string, d Decoder) <-chan *KeyGap {
+func (w *Walker) Gaps() <-chan *KeyGap {
 	q := make(chan *KeyGap)
-	go func() {
+	w.run(func() {
 		defer close(q)
 
-		gs := make(map[string]Packet)
-		for p := range Walk(paths, d) {
+		gs := w.State
+		if gs == nil {
+			gs = NewState()
+		}
+		w.apply(func(p Packet) error {
 			id := defaultPacketKey(p)
-			if g := p.Diff(gs[id]); g != nil {
+			if gs.Skip(id, p) {
+				return nil
+			}
+			if g := p.Diff(gs.Last(id)); g != nil {
 				k := &KeyGap{
 					Key: id,
 					Gap: g,
 				}
-				q <- k
+				select {
+				case q <- k:
+				case <-w.ctx.Done():
+					return w.ctx.Err()
+				}
 			}
-			gs[id] = p
-		}
-	}()
+			gs.Update(id, p)
+			return nil
+		}, gs.detach)
+	})
 	return q
 }
 
@@ -96,97 +519,283 @@ type KeyTimeCoze struct {
 	When time.Time
 }
 
-func CountByDay(paths []string, d Decoder) <-chan *KeyTimeCoze {
+func (w *Walker) CountByDay() <-chan *KeyTimeCoze {
+	return w.CountBy(Bucket{Width: Day}, false)
+}
+
+// CountBy counts packets per key in the given buckets. When empty is true,
+// the buckets without packets are reported with a zero count.
+func (w *Walker) CountBy(b Bucket, empty bool) <-chan *KeyTimeCoze {
+	c := NewCounter(b)
+	c.Empty = empty
+	return w.Count(c)
+}
+
+// Count counts the packets of the walker with c.
+func (w *Walker) Count(c *Counter) <-chan *KeyTimeCoze {
 	q := make(chan *KeyTimeCoze)
-	go func() {
+	send := func(ks []*KeyTimeCoze) bool {
+		for _, k := range ks {
+			select {
+			case q <- k:
+			case <-w.ctx.Done():
+				return false
+			}
+		}
+		return true
+	}
+	w.run(func() {
 		defer close(q)
 
-		gs := make(map[string]*KeyTimeCoze)
-		ps := make(map[string]Packet)
-		for p := range Walk(paths, d) {
-			id := defaultPacketKey(p)
-			c := gs[id]
-			if c != nil && p.Timestamp().Sub(c.When) >= Day {
-				q <- c
-				delete(gs, id)
-			}
-			if _, ok := gs[id]; !ok {
-				i, _ := p.Id()
-				c = &KeyTimeCoze{
-					Coze: &Coze{Id: i},
-					Key:  id,
-					When: p.Timestamp().Truncate(Day),
-				}
-			}
-			c.Count++
-			c.Size += uint64(p.Len())
-			if g := p.Diff(ps[id]); g != nil {
-				c.Missing += uint64(g.Missing())
-			}
-			if p.Error() {
-				c.Error++
-			}
-			ps[id], gs[id] = p, c
+		if w.Key != nil {
+			c.Key = w.Key
 		}
-		for _, c := range gs {
-			q <- c
+		if w.State != nil {
+			c.State = w.State
 		}
-	}()
+		c.restore()
+		w.apply(func(p Packet) error {
+			if !send(c.Add(p)) {
+				return w.ctx.Err()
+			}
+			return nil
+		}, c.detach)
+		send(c.Flush())
+	})
 	return q
 }
 
-func Infos(paths []string, d Decoder) <-chan *Info {
-	q := make(chan *Info)
-	go func() {
-		defer close(q)
-		for p := range Walk(paths, d) {
-			q <- p.PacketInfo()
+// DefaultLateness is the delay during which a bucket stays open after the
+// packets of the following buckets are seen.
+const DefaultLateness = time.Hour
+
+// Counter counts packets per key and bucket. The packets can come out of
+// order: the buckets of a key stay open until the latest packet seen is
+// Lateness after their end. A packet coming later than that starts a new
+// bucket.
+type Counter struct {
+	Key      func(Packet) string
+	Empty    bool
+	Lateness time.Duration
+	State    *State
+
+	bucket Bucket
+	open   map[string]map[time.Time]*KeyTimeCoze
+	last   map[string]*KeyTimeCoze
+	latest time.Time
+	mark   time.Time
+}
+
+func NewCounter(b Bucket) *Counter {
+	return &Counter{
+		Lateness: DefaultLateness,
+		State:    NewState(),
+		bucket:   b,
+		open:     make(map[string]map[time.Time]*KeyTimeCoze),
+		last:     make(map[string]*KeyTimeCoze),
+	}
+}
+
+// Add counts p in the bucket of its key. It returns the buckets closed by p,
+// with the empty buckets between them if Empty is set.
+func (c *Counter) Add(p Packet) []*KeyTimeCoze {
+	id := defaultPacketKey(p)
+	key := id
+	if c.Key != nil {
+		key = c.Key(p)
+	}
+	if c.State.Skip(id, p) {
+		return nil
+	}
+	var when time.Time
+	if !c.bucket.IsZero() {
+		when = c.bucket.Truncate(p.Timestamp())
+	}
+	bs := c.open[key]
+	if bs == nil {
+		bs = make(map[time.Time]*KeyTimeCoze)
+		c.open[key] = bs
+	}
+	k := bs[when]
+	if k == nil {
+		i, _ := p.Id()
+		k = &KeyTimeCoze{
+			Coze: &Coze{Id: i},
+			Key:  key,
+			When: when,
 		}
-	}()
-	return q
+		bs[when] = k
+	}
+	k.Add(p, c.State.Last(id))
+	c.State.Update(id, p)
+
+	if c.bucket.IsZero() || !p.Timestamp().After(c.latest) {
+		return nil
+	}
+	c.latest = p.Timestamp()
+	mark := c.bucket.Truncate(c.latest.Add(-c.Lateness))
+	if !mark.After(c.mark) {
+		return nil
+	}
+	c.mark = mark
+	return c.close(func(k *KeyTimeCoze) bool { return c.bucket.Next(k.When).After(mark) })
 }
 
-func walk(p string, q chan Packet, d Decoder) error {
-	var rt *Reader
-	return filepath.Walk(p, func(p string, i os.FileInfo, err error) error {
-		if err != nil {
-			return err
+// close returns the open buckets for which keep is false.
+func (c *Counter) close(keep func(*KeyTimeCoze) bool) []*KeyTimeCoze {
+	var ks []*KeyTimeCoze
+	for key, bs := range c.open {
+		for w, k := range bs {
+			if keep != nil && keep(k) {
+				continue
+			}
+			ks = append(ks, k)
+			delete(bs, w)
 		}
-		if i.IsDir() {
-			return nil
+		if len(bs) == 0 {
+			delete(c.open, key)
 		}
-		r, err := os.Open(p)
-		if err != nil {
-			return err
+	}
+	sortKeyTimeCoze(ks)
+	if !c.Empty || c.bucket.IsZero() {
+		return ks
+	}
+	var vs []*KeyTimeCoze
+	for _, k := range ks {
+		l, ok := c.last[k.Key]
+		if ok {
+			vs = append(vs, c.fill(l, k.When)...)
 		}
-		defer r.Close()
+		if !ok || k.When.After(l.When) {
+			c.last[k.Key] = k
+		}
+		vs = append(vs, k)
+	}
+	sortKeyTimeCoze(vs)
+	return vs
+}
 
-		if rt == nil {
-			rt = NewReader(r, d)
-		} else {
-			rt.Reset(r)
+// MaxEmptyBuckets limits the number of empty buckets reported after a bucket
+// so that a corrupted timestamp far in the future does not exhaust memory.
+const MaxEmptyBuckets = 4096
+
+func (c *Counter) fill(k *KeyTimeCoze, until time.Time) []*KeyTimeCoze {
+	var ks []*KeyTimeCoze
+	for w := c.bucket.Next(k.When); w.Before(until) && len(ks) < MaxEmptyBuckets; w = c.bucket.Next(w) {
+		ks = append(ks, &KeyTimeCoze{
+			Coze: &Coze{Id: k.Id},
+			Key:  k.Key,
+			When: w,
+		})
+	}
+	return ks
+}
+
+// detach copies the packets kept by the counter.
+func (c *Counter) detach() {
+	if c.State != nil {
+		c.State.detach()
+	}
+}
+
+// restore reopens the buckets kept in the state by a previous Flush.
+func (c *Counter) restore() {
+	if c.State == nil || c.State.counter == nil {
+		return
+	}
+	cs := c.State.counter
+	c.State.counter = nil
+
+	c.latest, c.mark = cs.Latest, cs.Mark
+	for _, b := range cs.Open {
+		bs := c.open[b.Key]
+		if bs == nil {
+			bs = make(map[time.Time]*KeyTimeCoze)
+			c.open[b.Key] = bs
+		}
+		bs[b.When] = b.keyTimeCoze()
+	}
+	for _, b := range cs.Last {
+		c.last[b.Key] = b.keyTimeCoze()
+	}
+}
+
+// Flush returns the open buckets of each key. If Empty is set, the keys are
+// completed with empty buckets up to the bucket of the latest packet seen.
+//
+// When the state of the counter is saved in a file, the buckets still open
+// are kept in the state instead so that the next run completes them.
+func (c *Counter) Flush() []*KeyTimeCoze {
+	if c.State != nil && c.State.persist && !c.bucket.IsZero() {
+		cs := counterState{Latest: c.latest, Mark: c.mark}
+		for _, bs := range c.open {
+			for _, k := range bs {
+				cs.Open = append(cs.Open, newStateBucket(k))
+			}
 		}
-		// rt := NewReader(r, d)
-		for p := range rt.Packets() {
-			q <- p
+		for _, k := range c.last {
+			cs.Last = append(cs.Last, newStateBucket(k))
 		}
+		c.State.counter = &cs
+		c.open = make(map[string]map[time.Time]*KeyTimeCoze)
+		c.last = make(map[string]*KeyTimeCoze)
 		return nil
+	}
+	ks := c.close(nil)
+	if c.Empty && !c.bucket.IsZero() {
+		end := c.bucket.Next(c.bucket.Truncate(c.latest))
+		for _, k := range c.last {
+			ks = append(ks, c.fill(k, end)...)
+		}
+		sortKeyTimeCoze(ks)
+	}
+	c.last = make(map[string]*KeyTimeCoze)
+	return ks
+}
+
+func sortKeyTimeCoze(ks []*KeyTimeCoze) {
+	sort.Slice(ks, func(i, j int) bool {
+		if ks[i].When.Equal(ks[j].When) {
+			return ks[i].Key < ks[j].Key
+		}
+		return ks[i].When.Before(ks[j].When)
 	})
 }
 
+func (w *Walker) Infos() <-chan *Info {
+	q := make(chan *Info)
+	w.run(func() {
+		defer close(q)
+		for p := range w.Walk() {
+			select {
+			case q <- p.PacketInfo():
+			case <-w.ctx.Done():
+				return
+			}
+		}
+	})
+	return q
+}
+
+func Interrupt() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		defer signal.Stop(sig)
+		select {
+		case <-sig:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
 func defaultPacketKey(p Packet) string {
-	switch p := p.(type) {
-	case *TMPacket:
-		return fmt.Sprint(p.CCSDS.Apid())
-	case *PDPacket:
-		return fmt.Sprintf("0x%x", p.UMI.Code[:])
-	case *VMUPacket:
-		return p.VMU.Channel.String()
-	case HRPacket:
-		i, _ := p.Id()
-		return fmt.Sprintf("%x/%s/%s", i, p.Type(), p.String())
-	default:
-		i, _ := p.Id()
-		return fmt.Sprint(i)
+	if f := LookupPacket(p); f != nil && f.Key != nil {
+		return f.Key(p)
 	}
+	i, _ := p.Id()
+	return fmt.Sprint(i)
 }
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+var testTime = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func testVMUPacket(t *testing.T, channel VMUChannel, seq int, when time.Time) Packet {
+	t.Helper()
+	bs, err := EncodeVMU(0, 0, 0)(int(channel), seq, when, make([]byte, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := DecodeVMU().Decode(bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+type testBucket struct {
+	Key   string
+	When  time.Duration
+	Count uint64
+}
+
+func checkBuckets(t *testing.T, what string, got []*KeyTimeCoze, want []testBucket) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Errorf("%s: got %d buckets, want %d", what, len(got), len(want))
+		for _, k := range got {
+			t.Logf("%s: %s %s %d", what, k.Key, k.When.Sub(testTime), k.Count)
+		}
+		return
+	}
+	for i, k := range got {
+		w := want[i]
+		if k.Key != w.Key || !k.When.Equal(testTime.Add(w.When)) || k.Count != w.Count {
+			t.Errorf("%s: bucket %d: got %s %s %d, want %s %s %d", what, i, k.Key, k.When.Sub(testTime), k.Count, w.Key, w.When, w.Count)
+		}
+	}
+}
+
+func TestCounterLateness(t *testing.T) {
+	c := NewCounter(Bucket{Width: time.Hour})
+	c.Lateness = 30 * time.Minute
+
+	data := []struct {
+		When time.Duration
+		Want []testBucket
+	}{
+		{When: 10 * time.Minute},
+		{When: 50 * time.Minute},
+		{When: 80 * time.Minute},
+		// late but the first bucket is still open
+		{When: 55 * time.Minute},
+		// the first bucket is closed once the latest packet is 30m after its end
+		{When: 100 * time.Minute, Want: []testBucket{{Key: "vic1", Count: 3}}},
+		// too late: a new bucket is started
+		{When: 30 * time.Minute},
+		{When: 110 * time.Minute},
+	}
+	for i, d := range data {
+		p := testVMUPacket(t, ChannelVic1, i, testTime.Add(d.When))
+		checkBuckets(t, d.When.String(), c.Add(p), d.Want)
+	}
+	want := []testBucket{
+		{Key: "vic1", Count: 1},
+		{Key: "vic1", When: time.Hour, Count: 3},
+	}
+	checkBuckets(t, "flush", c.Flush(), want)
+}
+
+func TestCounterEmptyBuckets(t *testing.T) {
+	c := NewCounter(Bucket{Width: time.Hour})
+	c.Lateness = 0
+	c.Empty = true
+
+	data := []struct {
+		Channel VMUChannel
+		When    time.Duration
+		Want    []testBucket
+	}{
+		{Channel: ChannelVic1, When: 10 * time.Minute},
+		{Channel: ChannelVic2, When: 20 * time.Minute},
+		{
+			Channel: ChannelVic1,
+			When:    190 * time.Minute,
+			Want: []testBucket{
+				{Key: "vic1", Count: 1},
+				{Key: "vic2", Count: 1},
+			},
+		},
+		{Channel: ChannelVic1, When: 200 * time.Minute},
+	}
+	for i, d := range data {
+		p := testVMUPacket(t, d.Channel, i, testTime.Add(d.When))
+		checkBuckets(t, d.When.String(), c.Add(p), d.Want)
+	}
+	// the keys are completed up to the bucket of the latest packet
+	want := []testBucket{
+		{Key: "vic1", When: time.Hour},
+		{Key: "vic2", When: time.Hour},
+		{Key: "vic1", When: 2 * time.Hour},
+		{Key: "vic2", When: 2 * time.Hour},
+		{Key: "vic1", When: 3 * time.Hour, Count: 2},
+		{Key: "vic2", When: 3 * time.Hour},
+	}
+	checkBuckets(t, "flush", c.Flush(), want)
+}